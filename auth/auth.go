@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/nyodas/forklift/forkliftcmd"
+)
+
+const (
+	MethodNone  = "none"
+	MethodToken = "token"
+	MethodHMAC  = "hmac"
+	MethodMTLS  = "mtls"
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Name   string
+	Groups []string
+	Method string
+}
+
+// Authenticator checks the bearer tokens, signed requests and client
+// certificates configured, any of them authenticates a request.
+type Authenticator struct {
+	tokens         map[string]string
+	hmacKeys       map[string]string
+	hmacMaxExpiry  time.Duration
+	clientCAs      *x509.CertPool
+	allowedOrigins []string
+	config         forkliftcmd.Auth
+	now            func() time.Time
+}
+
+func NewAuthenticator(config forkliftcmd.Auth) (*Authenticator, error) {
+	a := &Authenticator{
+		tokens:         make(map[string]string),
+		hmacMaxExpiry:  config.HMACMaxExpiry,
+		allowedOrigins: config.AllowedOrigins,
+		config:         config,
+		now:            time.Now,
+	}
+	if a.hmacMaxExpiry == 0 {
+		a.hmacMaxExpiry = forkliftcmd.DefaultHMACMaxExpiry
+	}
+	if config.TokensFile != "" {
+		identities, err := loadKeyFile(config.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		for identity, token := range identities {
+			if other, ok := a.tokens[token]; ok {
+				return nil, errs.WithF(data.WithField("file", config.TokensFile).
+					WithField("identity", identity).WithField("other", other), "Duplicate token")
+			}
+			a.tokens[token] = identity
+		}
+	}
+	if config.HMACKeysFile != "" {
+		keys, err := loadKeyFile(config.HMACKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		a.hmacKeys = keys
+	}
+	if config.ClientCA != "" {
+		pem, err := ioutil.ReadFile(config.ClientCA)
+		if err != nil {
+			return nil, errs.WithEF(err, data.WithField("file", config.ClientCA), "Failed to read client CA")
+		}
+		a.clientCAs = x509.NewCertPool()
+		if !a.clientCAs.AppendCertsFromPEM(pem) {
+			return nil, errs.WithF(data.WithField("file", config.ClientCA), "No certificate found in client CA")
+		}
+	}
+	return a, nil
+}
+
+// Enabled tells if requests have to be authenticated, as soon as any credential source is configured.
+func (a *Authenticator) Enabled() bool {
+	return a != nil && (a.config.TokensFile != "" || a.config.HMACKeysFile != "" || a.config.ClientCA != "")
+}
+
+// ClientCAs is the pool client certificates are verified against, nil without mTLS.
+func (a *Authenticator) ClientCAs() *x509.CertPool {
+	if a == nil {
+		return nil
+	}
+	return a.clientCAs
+}
+
+// Authenticate returns the identity of the caller of r with its groups.
+func (a *Authenticator) Authenticate(r *http.Request) (Identity, error) {
+	if !a.Enabled() {
+		return Identity{Method: MethodNone}, nil
+	}
+	identity, err := a.authenticate(r)
+	if err != nil {
+		return identity, err
+	}
+	identity.Groups = a.config.GroupsOf(identity.Name)
+	return identity, nil
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (Identity, error) {
+	scheme, credentials := splitAuthorization(r.Header.Get("Authorization"))
+	switch {
+	case strings.EqualFold(scheme, "Bearer") && len(a.tokens) > 0:
+		return a.authenticateToken(credentials)
+	case scheme == HMACScheme && a.hmacKeys != nil:
+		return a.authenticateHMAC(r, credentials)
+	case scheme == "" && a.clientCAs != nil && r.TLS != nil && len(r.TLS.PeerCertificates) > 0:
+		return a.authenticateCertificate(r)
+	}
+	return Identity{}, errs.With("No valid credentials")
+}
+
+func splitAuthorization(header string) (scheme string, credentials string) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+	return parts[0], strings.TrimSpace(parts[1])
+}
+
+func (a *Authenticator) authenticateToken(token string) (Identity, error) {
+	// compare with every token so the time taken doesn't tell which one matched
+	var identity string
+	for known, name := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			identity = name
+		}
+	}
+	if identity == "" {
+		return Identity{}, errs.With("Invalid token")
+	}
+	return Identity{Name: identity, Method: MethodToken}, nil
+}
+
+func (a *Authenticator) authenticateHMAC(r *http.Request, credentials string) (Identity, error) {
+	params, err := parseHMAC(credentials)
+	if err != nil {
+		return Identity{}, err
+	}
+	secret, ok := a.hmacKeys[params.keyID]
+	if !ok {
+		return Identity{}, errs.WithF(data.WithField("keyId", params.keyID), "Unknown signing key")
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return Identity{}, err
+	}
+	expected := signature(secret, r.Method, r.URL.RequestURI(), params.expires, body)
+	if !hmac.Equal([]byte(expected), []byte(params.signature)) {
+		return Identity{}, errs.WithF(data.WithField("keyId", params.keyID), "Invalid signature")
+	}
+	expires := time.Unix(params.expires, 0)
+	now := a.now()
+	if now.After(expires) {
+		return Identity{}, errs.WithF(data.WithField("keyId", params.keyID).WithField("expires", expires), "Signature expired")
+	}
+	if expires.Sub(now) > a.hmacMaxExpiry {
+		return Identity{}, errs.WithF(data.WithField("keyId", params.keyID).WithField("expires", expires),
+			"Signature expires too far in the future")
+	}
+	return Identity{Name: params.keyID, Method: MethodHMAC}, nil
+}
+
+func (a *Authenticator) authenticateCertificate(r *http.Request) (Identity, error) {
+	certs := r.TLS.PeerCertificates
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         a.clientCAs,
+		Intermediates: intermediates,
+		CurrentTime:   a.now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return Identity{}, errs.WithEF(err, data.WithField("subject", certs[0].Subject.String()), "Invalid client certificate")
+	}
+	return Identity{Name: certs[0].Subject.CommonName, Method: MethodMTLS}, nil
+}
+
+// CheckOrigin accepts requests without Origin, like the CLI, from the
+// server's own origin or from one of the allowed origins.
+func (a *Authenticator) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if a != nil {
+		for _, allowed := range a.allowedOrigins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+	}
+	logs.WithField("origin", origin).WithField("host", r.Host).Warn("Origin not allowed")
+	return false
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// FromContext returns the identity of an authenticated request.
+func FromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
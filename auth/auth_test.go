@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyodas/forklift/forkliftcmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestParseKeyFile(t *testing.T) {
+	keys, err := parseKeyFile("tokens", []byte("# ci\nci s3cr3t\n\ndeploy t0ken\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"ci": "s3cr3t", "deploy": "t0ken"}, keys)
+
+	_, err = parseKeyFile("tokens", []byte("ci"))
+	assert.Error(t, err)
+	_, err = parseKeyFile("tokens", []byte("ci a\nci b"))
+	assert.Error(t, err, "Names should be unique")
+}
+
+func TestDisabled(t *testing.T) {
+	a, err := NewAuthenticator(forkliftcmd.Auth{})
+	assert.NoError(t, err)
+	assert.False(t, a.Enabled())
+	identity, err := a.Authenticate(httptest.NewRequest("GET", "/echo", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, MethodNone, identity.Method)
+}
+
+func TestEmptyKeyFile(t *testing.T) {
+	for _, content := range []string{"", "# every token was removed\n\n"} {
+		_, err := NewAuthenticator(forkliftcmd.Auth{TokensFile: writeFile(t, "tokens", content)})
+		assert.Error(t, err, "An empty tokens file should not disable authentication")
+		_, err = NewAuthenticator(forkliftcmd.Auth{HMACKeysFile: writeFile(t, "keys", content)})
+		assert.Error(t, err)
+	}
+	a := &Authenticator{config: forkliftcmd.Auth{TokensFile: "tokens"}}
+	assert.True(t, a.Enabled(), "Configured token sources should enable authentication")
+	_, err := a.Authenticate(httptest.NewRequest("GET", "/echo", nil))
+	assert.Error(t, err)
+}
+
+func TestDuplicateToken(t *testing.T) {
+	_, err := NewAuthenticator(forkliftcmd.Auth{TokensFile: writeFile(t, "tokens", "ci s3cr3t\nadmin s3cr3t\n")})
+	assert.Error(t, err, "A token shared by two identities should be rejected")
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	a, err := NewAuthenticator(forkliftcmd.Auth{TokensFile: writeFile(t, "tokens", "ci s3cr3t\n")})
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/echo", nil)
+	_, err = a.Authenticate(r)
+	assert.Error(t, err, "Requests without credentials should be rejected")
+
+	r.Header.Set("Authorization", "Bearer wrong")
+	_, err = a.Authenticate(r)
+	assert.Error(t, err)
+
+	r.Header.Set("Authorization", "Bearer s3cr3t")
+	identity, err := a.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{Name: "ci", Method: MethodToken}, identity)
+}
+
+func TestAuthenticateHMAC(t *testing.T) {
+	a, err := NewAuthenticator(forkliftcmd.Auth{
+		HMACKeysFile:  writeFile(t, "keys", "deploy k3y\n"),
+		HMACMaxExpiry: time.Minute,
+	})
+	assert.NoError(t, err)
+	now := time.Unix(1500000000, 0)
+	a.now = func() time.Time { return now }
+
+	sign := func(uri string, secret string, expires time.Time) error {
+		r := httptest.NewRequest("GET", "/exec", nil)
+		r.Header.Set("Authorization", SignRequest("deploy", secret, "GET", uri, nil, expires))
+		identity, err := a.Authenticate(r)
+		if err == nil {
+			assert.Equal(t, Identity{Name: "deploy", Method: MethodHMAC}, identity)
+		}
+		return err
+	}
+	assert.NoError(t, sign("/exec", "k3y", now.Add(30*time.Second)))
+	assert.Error(t, sign("/exec", "wrong", now.Add(30*time.Second)), "Bad secrets should be rejected")
+	assert.Error(t, sign("/echo", "k3y", now.Add(30*time.Second)), "Signatures should be bound to the uri")
+	assert.Error(t, sign("/exec", "k3y", now.Add(-time.Second)), "Expired signatures should be rejected")
+	assert.Error(t, sign("/exec", "k3y", now.Add(time.Hour)), "Signatures valid too long should be rejected")
+
+	signed := []byte(`{"Command": "backup"}`)
+	post := func(body string) (*http.Request, error) {
+		r := httptest.NewRequest("POST", "/api/jobs", strings.NewReader(body))
+		r.Header.Set("Authorization", SignRequest("deploy", "k3y", "POST", "/api/jobs", signed, now.Add(30*time.Second)))
+		_, err := a.Authenticate(r)
+		return r, err
+	}
+	r, err := post(string(signed))
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, signed, body, "The body should be kept for the handlers")
+	}
+	_, err = post(`{"Command": "drop-database"}`)
+	assert.Error(t, err, "Signatures should be bound to the body")
+}
+
+func newCert(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+func TestAuthenticateCertificate(t *testing.T) {
+	validity := func(serial int64, name string) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+	}
+	caTemplate := validity(1, "forklift ca")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign
+	ca, caKey := newCert(t, caTemplate, nil, nil)
+	clientTemplate := validity(2, "laptop")
+	clientTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	client, _ := newCert(t, clientTemplate, ca, caKey)
+	other, _ := newCert(t, validity(3, "other"), nil, nil)
+
+	a, err := NewAuthenticator(forkliftcmd.Auth{
+		ClientCA: writeFile(t, "ca.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))),
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, a.ClientCAs())
+
+	r := httptest.NewRequest("GET", "/echo", nil)
+	_, err = a.Authenticate(r)
+	assert.Error(t, err, "Plain connections should be rejected")
+
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client}}
+	identity, err := a.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{Name: "laptop", Method: MethodMTLS}, identity)
+
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{other}}
+	_, err = a.Authenticate(r)
+	assert.Error(t, err, "Certificates from another CA should be rejected")
+}
+
+func TestCheckOrigin(t *testing.T) {
+	a, err := NewAuthenticator(forkliftcmd.Auth{AllowedOrigins: []string{"https://ops.example.com"}})
+	assert.NoError(t, err)
+	r := httptest.NewRequest("GET", "http://forklift:8080/echo", nil)
+	assert.True(t, a.CheckOrigin(r), "Requests without Origin should be accepted")
+	r.Header.Set("Origin", "http://forklift:8080")
+	assert.True(t, a.CheckOrigin(r))
+	r.Header.Set("Origin", "https://ops.example.com")
+	assert.True(t, a.CheckOrigin(r))
+	r.Header.Set("Origin", "https://evil.example.com")
+	assert.False(t, a.CheckOrigin(r))
+}
+
+func TestAuthenticateGroups(t *testing.T) {
+	a, err := NewAuthenticator(forkliftcmd.Auth{
+		TokensFile: writeFile(t, "tokens", "ci s3cr3t\n"),
+		Groups:     map[string][]string{"deployers": {"ci"}, "ops": {"alice"}},
+	})
+	assert.NoError(t, err)
+	r := httptest.NewRequest("GET", "/echo", nil)
+	r.Header.Set("Authorization", "Bearer s3cr3t")
+	identity, err := a.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"deployers"}, identity.Groups)
+}
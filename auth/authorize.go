@@ -0,0 +1,22 @@
+package auth
+
+import (
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/nyodas/forklift/forkliftcmd"
+)
+
+// Authorize tells if identity may perform action on command and logs the decision.
+func Authorize(identity Identity, command forkliftcmd.ForkliftCommand, action string) bool {
+	allowed := command.Allows(identity.Name, identity.Groups, action)
+	entry := logs.WithField("identity", identity.Name).
+		WithField("groups", identity.Groups).
+		WithField("command", command.Shortname).
+		WithField("action", action).
+		WithField("allowed", allowed)
+	if allowed {
+		entry.Info("Authorization granted")
+	} else {
+		entry.Warn("Authorization denied")
+	}
+	return allowed
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// HMACScheme is the Authorization scheme of signed requests:
+//
+//	Authorization: Forklift-HMAC keyId=<id>,expires=<unix time>,signature=<hex>
+//
+// The signature is the HMAC-SHA256 of "<method>\n<request uri>\n<expires>\n<body sha256 hex>".
+const HMACScheme = "Forklift-HMAC"
+
+// maxSignedBody bounds the body read to check the signature of a request.
+const maxSignedBody = 1 << 20
+
+func signature(secret string, method string, uri string, expires int64, body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", method, uri, expires, hex.EncodeToString(digest[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest returns the Authorization header value of a request with body valid until expires.
+func SignRequest(keyID string, secret string, method string, uri string, body []byte, expires time.Time) string {
+	return fmt.Sprintf("%s keyId=%s,expires=%d,signature=%s", HMACScheme, keyID, expires.Unix(),
+		signature(secret, method, uri, expires.Unix(), body))
+}
+
+// readBody returns the body of r and puts it back for the next handlers.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, errs.WithE(err, "Failed to read request body")
+	}
+	if len(body) > maxSignedBody {
+		return nil, errs.WithF(data.WithField("max", maxSignedBody), "Signed request body too large")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+type hmacParams struct {
+	keyID     string
+	expires   int64
+	signature string
+}
+
+func parseHMAC(credentials string) (params hmacParams, err error) {
+	for _, param := range strings.Split(credentials, ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			return params, errs.WithF(data.WithField("param", param), "Invalid signature parameter")
+		}
+		switch kv[0] {
+		case "keyId":
+			params.keyID = kv[1]
+		case "expires":
+			if params.expires, err = strconv.ParseInt(kv[1], 10, 64); err != nil {
+				return params, errs.WithEF(err, data.WithField("expires", kv[1]), "Invalid signature expiry")
+			}
+		case "signature":
+			params.signature = kv[1]
+		}
+	}
+	if params.keyID == "" || params.expires == 0 || params.signature == "" {
+		return params, errs.With("Signature needs keyId, expires and signature")
+	}
+	return params, nil
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strings"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// loadKeyFile reads "<name> <secret>" lines, empty lines and # comments are skipped.
+// A file without any key is an error, a truncated file must not let everyone in.
+func loadKeyFile(path string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errs.WithEF(err, data.WithField("file", path), "Failed to read key file")
+	}
+	keys, err := parseKeyFile(path, content)
+	if err == nil && len(keys) == 0 {
+		return nil, errs.WithF(data.WithField("file", path), "No key found in key file")
+	}
+	return keys, err
+}
+
+func parseKeyFile(path string, content []byte) (map[string]string, error) {
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errs.WithF(data.WithField("file", path).WithField("line", lineNumber),
+				"Expected '<name> <secret>'")
+		}
+		if _, ok := keys[fields[0]]; ok {
+			return nil, errs.WithF(data.WithField("file", path).WithField("line", lineNumber).
+				WithField("name", fields[0]), "Duplicate name")
+		}
+		keys[fields[0]] = fields[1]
+	}
+	return keys, nil
+}
@@ -1,30 +1,133 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/mgutz/str"
 	"github.com/n0rad/go-erlog"
+	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/logs"
 	_ "github.com/n0rad/go-erlog/register"
+	"github.com/nyodas/forklift/auth"
 	"github.com/nyodas/forklift/erlog-forklift"
 	"github.com/nyodas/forklift/msg"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
-var addr = flag.String("addr", "localhost:8080", "http service address")
-var args = flag.String("args", "-l -a -h 'yolo'", "Args.")
+// lostExitCode is the exit code when the socket closed before the command ended.
+const lostExitCode = 255
+
+var addr = flag.String("addr", "localhost:8080", "http service address, host:port, ws://host:port, wss://host:port or unix:///path/to.sock")
+var args = flag.String("args", "", "Args, only for commands with allowArgs (default is the configured args)")
 var execCmd = flag.String("e", "consume", "shortname of the command")
 var remoteArgs = flag.Bool("remoteargs", false, "print remote args")
 var logLevel = flag.String("L", "info", "Loglevel  (default is INFO)")
+var interactive = flag.Bool("i", false, "forward stdin to the remote command even when it is a terminal")
+var detachJob = flag.Bool("d", false, "start the command as a job and detach from it")
+var offset = flag.Int64("offset", 0, "output offset to resume from when attaching")
+var token = flag.String("token", os.Getenv("FORKLIFT_TOKEN"), "bearer token (default is $FORKLIFT_TOKEN)")
+var hmacKeyID = flag.String("hmac-key-id", "", "key id to sign the request with")
+var hmacSecretFile = flag.String("hmac-secret-file", "", "file holding the secret of -hmac-key-id")
+var certFile = flag.String("cert", "", "client certificate for mTLS, implies wss")
+var keyFile = flag.String("key", "", "client certificate key (default is -cert)")
+var caFile = flag.String("ca", "", "CA file to verify the server certificate with, implies wss")
+var insecure = flag.Bool("insecure", false, "don't verify the server certificate, implies wss")
+var tty = flag.Bool("t", false, "put the local terminal in raw mode and forward its size, for commands running in a tty")
+var envVars = keyValueFlag{}
+var paramValues = keyValueFlag{}
+
+// keyValueFlag collects repeated KEY=value flags.
+type keyValueFlag map[string]string
+
+func (e keyValueFlag) String() string {
+	return fmt.Sprint(map[string]string(e))
+}
+
+func (e keyValueFlag) Set(value string) error {
+	i := strings.IndexByte(value, '=')
+	if i < 1 {
+		return fmt.Errorf("expected KEY=value, got %q", value)
+	}
+	e[value[:i]] = value[i+1:]
+	return nil
+}
+
+func init() {
+	flag.Var(envVars, "env", "KEY=value environment variable for the remote command, repeatable")
+	flag.Var(paramValues, "p", "name=value param of a remote command declaring params, repeatable (-args \"\" runs it with the defaults)")
+}
+
+// terminalSize returns the size of the local terminal, zero if stdout is not one.
+func terminalSize() msg.TerminalSize {
+	cols, rows, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return msg.TerminalSize{}
+	}
+	return msg.TerminalSize{Rows: uint16(rows), Cols: uint16(cols)}
+}
+
+// readStdin sends the chunks read on stdin and closes the channel at EOF.
+func readStdin(input chan<- []byte) {
+	defer close(input)
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			input <- buf[:n]
+		}
+		if err != nil {
+			if err != io.EOF {
+				logs.WithE(err).Warn("Failed to read stdin")
+			}
+			return
+		}
+	}
+}
+
+func printJobs(jobs []msg.JobInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCOMMAND\tSTATUS\tSTARTED\tCLIENTS\tOFFSET")
+	for _, job := range jobs {
+		status := "running"
+		if job.Exit != nil {
+			status = fmt.Sprintf("exited (%d)", job.Exit.Code)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\n", job.ID, job.Command, status,
+			job.StartedAt.Format(time.RFC3339), job.Clients, job.Offset)
+	}
+	w.Flush()
+}
 
 func main() {
 	flag.Parse()
+	subcommand := flag.Arg(0)
+	switch subcommand {
+	case "", "exec", "list":
+	case "attach", "detach":
+		if flag.Arg(1) == "" {
+			fmt.Fprintf(os.Stderr, "usage: %s [flags] %s <job-id>\n", os.Args[0], subcommand)
+			os.Exit(2)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] [exec|list|attach <job-id>|detach <job-id>]\n", os.Args[0])
+		os.Exit(2)
+	}
 	customAppender := erlog_forklift.NewForkliftErlogWriterAppender(os.Stdout)
 	logWs := logs.GetLog("logWs")
 	logWs.(*erlog.ErlogLogger).Appenders = []erlog.Appender{customAppender}
@@ -40,26 +143,160 @@ func main() {
 	signal.Notify(interrupt, os.Interrupt)
 
 	u := url.URL{Scheme: "ws", Host: *addr, Path: "/echo"}
+	if i := strings.Index(*addr, "://"); i >= 0 {
+		u.Scheme, u.Host = (*addr)[:i], (*addr)[i+3:]
+	}
+	dialer := *websocket.DefaultDialer
+	if u.Scheme == "unix" {
+		socket := u.Host
+		u.Scheme, u.Host = "ws", "localhost"
+		dialer.NetDial = func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		}
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: *insecure}
+	if *caFile != "" {
+		ca, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			logs.WithE(err).WithField("ca", *caFile).Fatal("Failed to read CA file")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			logs.WithField("ca", *caFile).Fatal("No certificate found in CA file")
+		}
+	}
+	if *certFile != "" {
+		if *keyFile == "" {
+			*keyFile = *certFile
+		}
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			logs.WithE(err).WithField("cert", *certFile).Fatal("Failed to load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if *certFile != "" || *caFile != "" || *insecure {
+		u.Scheme = "wss"
+	}
+	if u.Scheme == "wss" {
+		if *insecure {
+			logs.Warn("Server certificate is not verified")
+		}
+		dialer.TLSClientConfig = tlsConfig
+	}
+	header := http.Header{}
+	if *token != "" {
+		header.Set("Authorization", "Bearer "+*token)
+	}
+	if *hmacKeyID != "" {
+		secret, err := ioutil.ReadFile(*hmacSecretFile)
+		if err != nil {
+			logs.WithE(err).WithField("file", *hmacSecretFile).Fatal("Failed to read hmac secret")
+		}
+		header.Set("Authorization", auth.SignRequest(*hmacKeyID, strings.TrimSpace(string(secret)),
+			http.MethodGet, u.RequestURI(), nil, time.Now().Add(time.Minute)))
+	}
 	logs.WithField("url", u.String()).Info("Connecting")
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	c, resp, err := dialer.Dial(u.String(), header)
+	if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+		logs.WithField("url", u.String()).Fatal("Authentication failed")
+	}
 	if err != nil {
 		logs.WithE(err).WithField("url", u.String()).Fatal("Failed to connect.")
 	}
 
-	isClosed := false
-	done := make(chan struct{})
+	resize := make(chan os.Signal, 1)
+	restoreTerminal := func() {}
+	if *tty && terminal.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := terminal.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			logs.WithE(err).Fatal("Failed to put terminal in raw mode")
+		}
+		restoreTerminal = func() {
+			_ = terminal.Restore(int(os.Stdin.Fd()), state)
+		}
+		signal.Notify(resize, syscall.SIGWINCH)
+	}
+
+	detachNow := make(chan struct{}, 1)
+	// stdinCredits lets the stdin messages written to the command be sent again, see msg.StdinWindow
+	stdinCredits := make(chan int, msg.StdinWindow)
+	// done gets the exit code once the socket is closed, the reader owns the state until then
+	done := make(chan int, 1)
 	go func() {
 		defer c.Close()
+		exitCode := 0
+		jobID := ""
+		jobOffset := int64(0)
+		exited := false
+		detached := false
+		// replied is set by the messages ending a request, a socket closed without one lost it
+		replied := false
 		for {
 			m := msg.CommandOutputLog{}
-			err := c.ReadJSON(&m)
+			_, content, err := c.ReadMessage()
+			if err == nil {
+				err = json.Unmarshal(content, &m)
+			}
 			if err != nil {
 				logs.WithE(err).Info("Socket is closed.")
-				close(done)
-				isClosed = true
+				if jobID != "" && !exited && !detached {
+					logs.WithField("job", jobID).
+						WithField("offset", jobOffset).
+						Warn("Connection lost, the job keeps running. Resume with: attach " + jobID + " -offset " + fmt.Sprint(jobOffset))
+				}
+				if !replied && exitCode == 0 {
+					logs.Error("Connection closed before the command ended")
+					exitCode = lostExitCode
+				}
+				done <- exitCode
 				break
 			}
+			switch m.Type {
+			case "log", "tty", "exit":
+				jobOffset++
+			case "stdin-credit":
+				credit := msg.StdinCredit{}
+				if err := json.Unmarshal(content, &credit); err == nil {
+					stdinCredits <- credit.Credit
+				}
+			case "attached":
+				attached := msg.JobAttached{}
+				if err := json.Unmarshal(content, &attached); err == nil {
+					jobID, jobOffset = attached.Content, attached.Offset
+					logs.WithField("job", jobID).WithField("offset", jobOffset).Info("Attached to job")
+					if *detachJob {
+						detachNow <- struct{}{}
+					}
+				}
+			case "detached":
+				detached, replied = true, true
+				logs.WithField("job", m.Content).
+					WithField("offset", jobOffset).
+					Info("Detached from job. Resume with: attach " + m.Content + " -offset " + fmt.Sprint(jobOffset))
+			case "jobs":
+				jobs := msg.JobList{}
+				if err := json.Unmarshal(content, &jobs); err == nil {
+					printJobs(jobs.Jobs)
+				}
+				replied = true
+			case "error":
+				errorMsg := msg.Error{}
+				_ = json.Unmarshal(content, &errorMsg)
+				logs.WithField("code", errorMsg.Code).
+					WithField("action", errorMsg.Action).
+					WithField("command", errorMsg.Command).
+					WithField("job", errorMsg.Job).
+					Error(m.Content)
+				exitCode = 1
+			}
+			if m.Type == "tty" {
+				raw := msg.CommandOutputRaw{}
+				if err := json.Unmarshal(content, &raw); err == nil {
+					_, _ = os.Stdout.Write(raw.Data)
+				}
+			}
 			if m.Type == "log" {
 				m.Content = strings.TrimRight(m.Content, "\n")
 				if m.Prefix == "stdout" {
@@ -70,6 +307,27 @@ func main() {
 			}
 			if m.Type == "args" {
 				fmt.Printf(m.Content + "\n")
+				replied = true
+			}
+			if m.Type == "exit" {
+				exitMsg := msg.CommandExit{}
+				if err := json.Unmarshal(content, &exitMsg); err != nil {
+					logs.WithE(err).Error("Failed to read exit message")
+					exitCode = 1
+					continue
+				}
+				exited, replied = true, true
+				exitCode = exitMsg.Code
+				fields := data.WithField("command", exitMsg.Content).
+					WithField("exitcode", exitMsg.Code).
+					WithField("signal", exitMsg.Signal).
+					WithField("duration", time.Duration(exitMsg.DurationMs)*time.Millisecond).
+					WithField("killedBy", exitMsg.KilledBy)
+				if exitMsg.KilledBy == "timeout" {
+					logs.WithFields(fields).Error("Remote command timed out")
+				} else {
+					logs.WithFields(fields).Debug("Remote command exited")
+				}
 			}
 		}
 	}()
@@ -79,17 +337,85 @@ func main() {
 			Type:    "exec",
 			Content: *execCmd,
 		},
-		Args: str.ToArgv(*args),
+		Env: envVars,
 	}
-
-	logs.Info("Sending forkliftcmd")
-	if *remoteArgs {
-		logs.Info("Gettings current args")
-		msgRequest.Type = "args"
+	if *args != "" {
+		msgRequest.Args = str.ToArgv(*args)
+	}
+	if len(paramValues) > 0 {
+		msgRequest.Args = nil
+		msgRequest.Params = paramValues
+	}
+	if *tty {
+		msgRequest.TerminalSize = terminalSize()
 	}
+	var stdinInput chan []byte
+	forwardStdin := *tty || *interactive
+	switch subcommand {
+	case "list":
+		msgRequest = msg.CommandRequest{Message: msg.Message{Type: "list"}}
+	case "attach":
+		msgRequest = msg.CommandRequest{Message: msg.Message{Type: "attach", Content: flag.Arg(1)}, Offset: *offset}
+	case "detach":
+		msgRequest = msg.CommandRequest{Message: msg.Message{Type: "detach", Content: flag.Arg(1)}}
+	default:
+		forwardStdin = forwardStdin || !terminal.IsTerminal(int(os.Stdin.Fd()))
+		if *remoteArgs {
+			logs.Info("Gettings current args")
+			msgRequest.Type = "args"
+			forwardStdin = false
+		}
+	}
+	if forwardStdin && (msgRequest.Type == "exec" || msgRequest.Type == "attach") && !*detachJob {
+		msgRequest.Stdin = true
+		stdinInput = make(chan []byte)
+	}
+
+	logs.WithField("type", msgRequest.Type).Info("Sending forkliftcmd")
 	_ = msgRequest.Send(c)
+	if stdinInput != nil {
+		go readStdin(stdinInput)
+	}
+	stdinWindow := msg.StdinWindow
 	for {
+		// out of window, stdin waits for the command to read what was sent
+		input := stdinInput
+		if stdinWindow == 0 {
+			input = nil
+		}
 		select {
+		case credit := <-stdinCredits:
+			stdinWindow += credit
+		case data, ok := <-input:
+			if !ok {
+				stdinInput = nil
+				messageEOF := msg.Message{
+					Type: "stdin-eof",
+				}
+				_ = messageEOF.Send(c)
+				continue
+			}
+			messageInput := msg.CommandInput{
+				Message: msg.Message{
+					Type: "stdin",
+				},
+				Data: data,
+			}
+			_ = messageInput.Send(c)
+			stdinWindow--
+		case <-detachNow:
+			messageDetach := msg.Message{
+				Type: "detach",
+			}
+			_ = messageDetach.Send(c)
+		case <-resize:
+			messageResize := msg.TerminalResize{
+				Message: msg.Message{
+					Type: "resize",
+				},
+				TerminalSize: terminalSize(),
+			}
+			_ = messageResize.Send(c)
 		case <-interrupt:
 			logs.Info("Received interrupt... Sending kill")
 			messageKill := msg.Message{
@@ -101,15 +427,10 @@ func main() {
 				logs.WithE(err).Error("Failed to Close the websocket connection.")
 				return
 			}
-		case <-done:
-			if isClosed == false {
-				logs.Info("Closing Websocket")
-				if c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")) != nil {
-					c.Close()
-				}
-			}
-			logs.Debug("We're done.Exiting")
-			os.Exit(0)
+		case exitCode := <-done:
+			restoreTerminal()
+			logs.WithField("exitcode", exitCode).Debug("We're done.Exiting")
+			os.Exit(exitCode)
 			return
 		}
 	}
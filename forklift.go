@@ -3,112 +3,260 @@ package main
 import (
 	"errors"
 	"flag"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/mgutz/str"
 	"github.com/n0rad/go-erlog/logs"
 	_ "github.com/n0rad/go-erlog/register"
+	"github.com/nyodas/forklift/auth"
 	"github.com/nyodas/forklift/forkliftcmd"
 	forkliftHttp "github.com/nyodas/forklift/http"
 	forkliftRunner "github.com/nyodas/forklift/runner"
+	forkliftSupervisor "github.com/nyodas/forklift/supervisor"
 )
 
-var addr = flag.String("addr", "0.0.0.0:8080", "http service address")
+var addr = flag.String("addr", "0.0.0.0:8080", "http service address, host:port or unix:///path/to.sock. Ignored when socket activated")
 var commandName = flag.String("c", "/bin/ls", "Command to run")
 var commandCwd = flag.String("cwd", "/", "Cwd for the command")
 var commandArgs = flag.String("cargs", "", "Args for the default background command")
 var logLevel = flag.String("L", "info", "Loglevel  (default is INFO)")
 var execProc = flag.Bool("e", false, "Exec background process")
-var configPath = flag.String("config", "", "Config file path")
+var configPath = flag.String("config", "", "Config file path, or directory of *.yml config files")
+var validateConfig = flag.Bool("validate", false, "Check the config file and exit, non-zero when invalid")
 var postStopHook = flag.String("S", "", "PostStopHook when exec.")
+var cgroupRoot = flag.String("cgroup-root", "", "Cgroup v2 under which commands get their cgroup (default is forklift's own)")
+var initMode = flag.Bool("init", false, "Run as init: reap zombies and forward signals to the commands (default when running as pid 1)")
+var tlsCert = flag.String("tls-cert", "", "TLS certificate file, serves https/wss. Reloaded on SIGHUP or when changed")
+var tlsKey = flag.String("tls-key", "", "TLS key file (default is -tls-cert)")
+var socketMode = flag.String("socket-mode", "0660", "Permissions of the unix socket of -addr")
+var socketOwner = flag.String("socket-owner", "", "user[:group] owning the unix socket of -addr")
+
+// forwardedSignals are relayed to the commands in init mode.
+var forwardedSignals = []os.Signal{syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGWINCH}
 
 func main() {
+	forkliftRunner.MaybeExecLimits()
 	flag.Parse()
 	level, err := logs.ParseLevel(*logLevel)
 	if err != nil {
 		logs.WithField("value", logLevel).Fatal("Unknown log level")
 	}
 	logs.SetLevel(level)
-	file, err := loadConfig(*configPath)
-	if err != nil {
+	var cmdConfig forkliftcmd.ForkliftCommandConfig
+	hasConfig := true
+	if err = configExists(*configPath); err != nil {
+		if *validateConfig {
+			logs.WithE(err).WithField("configfile", *configPath).Fatal("Failed to read config file")
+		}
 		logs.WithE(err).WithField("configfile", configPath).
 			Error("Config file empty or missing")
+		hasConfig = false
 	}
-
-	cmdConfig, err := forkliftcmd.MapConfigFile(file)
-	if err != nil {
-		logs.WithE(err).WithField("configfile", configPath).
-			WithField("config", cmdConfig).
-			Fatal("Failed to map forkliftcmd config file")
+	if hasConfig {
+		cmdConfig, err = loadConfig(*configPath)
+		if err != nil {
+			logs.WithE(err).WithField("configfile", configPath).
+				WithField("config", cmdConfig).
+				Fatal("Failed to map forkliftcmd config file")
+		}
+	}
+	if *validateConfig {
+		logs.WithField("configfile", *configPath).Info("Config file is valid")
+		return
 	}
 	logs.WithE(err).WithField("configfile", configPath).
 		WithField("config", cmdConfig).Debug("cmdConfig Content")
+	// before any command starts so they don't inherit the sockets
+	listeners, err := forkliftHttp.ActivationListeners()
+	if err != nil {
+		logs.WithE(err).Fatal("Failed to use socket activation listeners")
+	}
 	defaultCmd := cmdConfig.SetDefaultCommand(*commandName, *commandCwd)
+	forkliftRunner.SetCgroupRoot(*cgroupRoot)
+	metrics := forkliftHttp.NewMetrics()
+	forkliftRunner.SetObserver(metrics)
+	isInit := *initMode || os.Getpid() == 1
+	if isInit {
+		forkliftRunner.StartReaper()
+	}
 
+	var cmdSupervisor *forkliftSupervisor.Supervisor
+	// configSupervisor runs the local commands of the config, it follows the config reloads
+	var configSupervisor *forkliftSupervisor.Supervisor
 	if *execProc {
-		if file != nil && *commandArgs == "" {
-			runBackgroundCmds(cmdConfig.LocalConfig)
+		cmdSupervisor = forkliftSupervisor.NewSupervisor()
+		if hasConfig && *commandArgs == "" {
+			configSupervisor = cmdSupervisor
+			runBackgroundCmds(cmdSupervisor, cmdConfig.LocalConfig)
 		} else {
-			defaultCmd.Args = *commandArgs
+			defaultCmd.Args = str.ToArgv(*commandArgs)
 			defaultCmd.PostStopHook = *postStopHook
-			runBackgroundCmd(defaultCmd)
+			defaultCmd.Critical = true
+			runBackgroundCmd(cmdSupervisor, defaultCmd)
 		}
 	}
 
-	forkliftHttpHandler := forkliftHttp.Handler{
+	authenticator, err := auth.NewAuthenticator(cmdConfig.Auth)
+	if err != nil {
+		logs.WithE(err).Fatal("Failed to load authentication config")
+	}
+	checkAuth(cmdConfig, authenticator)
+	jobs := forkliftHttp.NewJobRegistry()
+	jobs.Metrics = metrics
+	go exitHandler(cmdSupervisor, jobs, isInit)
+	forkliftHttpHandler := &forkliftHttp.Handler{
 		ForkliftConfig: &cmdConfig,
+		Jobs:           jobs,
+		Auth:           authenticator,
+		Metrics:        metrics,
+		Supervisor:     cmdSupervisor,
 	}
-	http.HandleFunc("/echo", forkliftHttpHandler.ExecRemoteCmd)
-	http.HandleFunc("/exec", forkliftHttpHandler.ExecRemoteCmd)
+	http.HandleFunc("/echo", forkliftHttpHandler.Authenticated(forkliftHttpHandler.ExecRemoteCmd))
+	http.HandleFunc("/exec", forkliftHttpHandler.Authenticated(forkliftHttpHandler.ExecRemoteCmd))
 	http.HandleFunc("/healthz", forkliftHttpHandler.Healthz)
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	http.HandleFunc("/readyz", forkliftHttpHandler.Readyz)
+	http.HandleFunc("/metrics", forkliftHttpHandler.Authenticated(forkliftHttpHandler.ServeMetrics))
+	http.HandleFunc(forkliftHttp.APIPrefix, forkliftHttpHandler.Authenticated(forkliftHttpHandler.API))
+	if len(listeners) == 0 {
+		listener, err := forkliftHttp.Listen(*addr, socketOptions())
+		if err != nil {
+			logs.WithE(err).WithField("addr", *addr).Fatal("Failed to listen")
+		}
+		listeners = append(listeners, listener)
+	}
+	var reloadables []reloadable
+	if *configPath != "" {
+		configReloader := newConfigReloader(*configPath, cmdConfig, forkliftHttpHandler, configSupervisor)
+		go configReloader.Watch(configCheckInterval, nil)
+		reloadables = append(reloadables, configReloader)
+	}
+	server := &http.Server{}
+	if *tlsCert == "" && authenticator.ClientCAs() != nil {
+		logs.Warn("Client certificates need TLS, set -tls-cert")
+	}
+	if *tlsCert != "" {
+		certReloader, err := forkliftHttp.NewCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			logs.WithE(err).Fatal("Failed to load TLS certificate")
+		}
+		go certReloader.Watch(forkliftHttp.DefaultCertCheckInterval, nil)
+		reloadables = append(reloadables, certReloader)
+		server.TLSConfig = forkliftHttp.TLSConfig(certReloader, forkliftHttpHandler.ClientCAs)
+	}
+	if len(reloadables) > 0 {
+		go reloadOnHangup(reloadables...)
+	}
+	served := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		logs.WithField("addr", listener.Addr()).WithField("tls", *tlsCert != "").Info("Listening")
+		go func(listener net.Listener) {
+			if *tlsCert != "" {
+				served <- server.ServeTLS(listener, "", "")
+			} else {
+				served <- server.Serve(listener)
+			}
+		}(listener)
+	}
+	log.Fatal(<-served)
 }
 
-func runBackgroundCmds(cmdConfigs []forkliftcmd.ForkliftCommand) {
+func socketOptions() forkliftHttp.SocketOptions {
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		logs.WithE(err).WithField("value", *socketMode).Fatal("Invalid socket mode")
+	}
+	owner := strings.SplitN(*socketOwner, ":", 2)
+	options := forkliftHttp.SocketOptions{Mode: os.FileMode(mode), User: owner[0]}
+	if len(owner) == 2 {
+		options.Group = owner[1]
+	}
+	return options
+}
+
+func runBackgroundCmds(cmdSupervisor *forkliftSupervisor.Supervisor, cmdConfigs []forkliftcmd.ForkliftCommand) {
 	for _, v := range cmdConfigs {
-		runBackgroundCmd(v)
+		runBackgroundCmd(cmdSupervisor, v)
 	}
 }
 
-func runBackgroundCmd(cmdConfig forkliftcmd.ForkliftCommand) {
-	runner := forkliftRunner.NewRunner(cmdConfig.Path, cmdConfig.Cwd, str.ToArgv(cmdConfig.Args))
-	runner.Timeout = cmdConfig.Timeout
-	runner.Oneshot = cmdConfig.Oneshot
-	runner.PostStopHook = cmdConfig.PostStopHook
-	done := make(chan struct{})
-	go func() {
-		runner.ExecLoop()
-		close(done)
-	}()
-	go exitHandler(done, runner)
+func runBackgroundCmd(cmdSupervisor *forkliftSupervisor.Supervisor, cmdConfig forkliftcmd.ForkliftCommand) {
+	if _, err := cmdSupervisor.Add(cmdConfig); err != nil {
+		logs.WithE(err).WithField("command", cmdConfig.Shortname).
+			Error("Failed to start background command")
+	}
 }
 
-func exitHandler(done chan struct{}, runner *forkliftRunner.Runner) {
+// exitHandler stops the commands and the jobs on SIGINT/SIGTERM, in init mode
+// the signal is forwarded to them and other signals are relayed.
+func exitHandler(cmdSupervisor *forkliftSupervisor.Supervisor, jobs *forkliftHttp.JobRegistry, isInit bool) {
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	forward := make(chan os.Signal, 1)
+	if isInit && cmdSupervisor != nil {
+		signal.Notify(forward, forwardedSignals...)
+	}
+	var done <-chan struct{}
+	if cmdSupervisor != nil {
+		done = cmdSupervisor.Done()
+	}
 	for {
 		select {
-		case <-interrupt:
-			runner.Stop()
-			os.Exit(1)
+		case sig := <-interrupt:
+			logs.WithField("signal", sig).Info("Stopping commands and exiting")
+			os.Exit(stopAll(cmdSupervisor, jobs, sig.(syscall.Signal), isInit))
+		case sig := <-forward:
+			cmdSupervisor.Signal(sig.(syscall.Signal))
 		case <-done:
-			logs.WithField("exitcode", runner.Status).
-				Debug("We're done.Exiting")
-			os.Exit(runner.Status)
-			return
+			logs.WithField("exitcode", cmdSupervisor.ExitStatus()).
+				Debug("Critical command ended. Exiting")
+			stopAll(cmdSupervisor, jobs, 0, false)
+			os.Exit(cmdSupervisor.ExitStatus())
 		}
 	}
 }
 
-func loadConfig(configPath string) (file []byte, err error) {
+// stopAll stops the jobs and the supervised commands together, in init mode sig
+// is sent instead of their stop signal and the critical command's status returned.
+func stopAll(cmdSupervisor *forkliftSupervisor.Supervisor, jobs *forkliftHttp.JobRegistry, sig syscall.Signal, isInit bool) int {
+	status := 1
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		jobs.StopAll()
+	}()
+	if cmdSupervisor != nil {
+		if isInit {
+			status = cmdSupervisor.Terminate(sig)
+		} else {
+			cmdSupervisor.StopAll()
+		}
+	}
+	wg.Wait()
+	return status
+}
+
+func configExists(configPath string) error {
 	if configPath == "" {
-		return nil, errors.New("No config file defined")
+		return errors.New("No config file defined")
 	}
+	_, err := os.Stat(configPath)
+	return err
+}
+
+// loadConfig reads the config file or directory at configPath and validates it.
+func loadConfig(configPath string) (config forkliftcmd.ForkliftCommandConfig, err error) {
 	logs.WithField("configfile", configPath).Debug("Loading config")
-	file, err = ioutil.ReadFile(configPath)
-	return file, err
+	if config, err = forkliftcmd.LoadConfig(configPath); err != nil {
+		return config, err
+	}
+	return config, config.Validate()
 }
@@ -2,7 +2,7 @@ package main
 
 import (
 	"io/ioutil"
-	"reflect"
+	"path/filepath"
 	"testing"
 )
 
@@ -14,11 +14,24 @@ func TestLoadConfigThrowError(t *testing.T) {
 }
 
 func TestLoadConfigNoErr(t *testing.T) {
-	d1 := []byte("test_load_config")
-	_ = ioutil.WriteFile("/tmp/.test", d1, 0644)
+	path := filepath.Join(t.TempDir(), "config.yml")
+	_ = ioutil.WriteFile(path, []byte("remoteCommand:\n- shortname: ls\n  path: /bin/ls\n"), 0644)
 
-	fileContent, err := loadConfig("/tmp/.test")
-	if err != nil && string(fileContent) == string(d1) && reflect.DeepEqual(fileContent, d1) {
+	config, err := loadConfig(path)
+	ls, _ := config.FindRemoteCommand("ls")
+	if err != nil || ls.Path != "/bin/ls" {
 		t.Error("File is present there shouldn't be any errors")
 	}
 }
+
+func TestLoadConfigInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	_ = ioutil.WriteFile(path, []byte("remoteCommand:\n- shortname: ls\n  path: /nonexistent/ls\n"), 0644)
+
+	if _, err := loadConfig(path); err == nil {
+		t.Error("Config with a missing command path should be rejected")
+	}
+	if err := configExists(filepath.Join(path, "missing")); err == nil {
+		t.Error("Missing config path should be reported")
+	}
+}
@@ -0,0 +1,71 @@
+package forkliftcmd
+
+import (
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+const (
+	ActionExec   = "exec"
+	ActionArgs   = "args"
+	ActionKill   = "kill"
+	ActionAttach = "attach"
+	// AnyAction and AnyIdentity match everything in an ACL rule.
+	AnyAction   = "*"
+	AnyIdentity = "*"
+)
+
+var actions = map[string]bool{ActionExec: true, ActionArgs: true, ActionKill: true, ActionAttach: true, AnyAction: true}
+
+// ACLRule allows the listed identities and members of the listed groups to perform actions.
+type ACLRule struct {
+	Identities []string `json:"identities,omitempty" yaml:"identities,omitempty"`
+	Groups     []string `json:"groups,omitempty" yaml:"groups,omitempty"`
+	Actions    []string `json:"actions,omitempty" yaml:"actions,omitempty"`
+}
+
+func validateACL(acl []ACLRule) error {
+	for _, rule := range acl {
+		for _, action := range rule.Actions {
+			if !actions[action] {
+				return errs.WithF(data.WithField("action", action), "Unknown ACL action")
+			}
+		}
+	}
+	return nil
+}
+
+// Allows tells if identity, member of groups, may perform action on the command.
+// A command without ACL allows every authenticated caller.
+func (fc ForkliftCommand) Allows(identity string, groups []string, action string) bool {
+	if len(fc.ACL) == 0 {
+		return true
+	}
+	for _, rule := range fc.ACL {
+		if rule.matches(identity, groups) && contains(rule.Actions, action, AnyAction) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule ACLRule) matches(identity string, groups []string) bool {
+	if identity != "" && contains(rule.Identities, identity, AnyIdentity) {
+		return true
+	}
+	for _, group := range groups {
+		if contains(rule.Groups, group, "") {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string, wildcard string) bool {
+	for _, v := range values {
+		if v == value || (wildcard != "" && v == wildcard) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package forkliftcmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/mgutz/str"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// Args of a command, configured as a list or as a string split like a shell does.
+type Args []string
+
+func (a *Args) UnmarshalJSON(b []byte) error {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case nil:
+		*a = nil
+	case []interface{}:
+		args := make(Args, len(value))
+		for i, arg := range value {
+			scalar, ok := scalarString(arg)
+			if !ok {
+				return errs.With("Args must be a string or a list of strings")
+			}
+			args[i] = scalar
+		}
+		*a = args
+	default:
+		scalar, ok := scalarString(value)
+		if !ok {
+			return errs.With("Args must be a string or a list of strings")
+		}
+		*a = str.ToArgv(scalar)
+	}
+	return nil
+}
+
+// scalarString reads yaml scalars as strings, like yaml's "args: 100".
+func scalarString(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		if value {
+			return "true", true
+		}
+		return "false", true
+	}
+	return "", false
+}
+
+// String renders the args as a string they can be read back from, quoting the ones that need it.
+func (a Args) String() string {
+	quoted := make([]string, len(a))
+	for i, arg := range a {
+		switch {
+		case arg != "" && !strings.ContainsAny(arg, " \t'\"\\"):
+			quoted[i] = arg
+		case !strings.Contains(arg, "'"):
+			quoted[i] = "'" + arg + "'"
+		default:
+			quoted[i] = `"` + arg + `"`
+		}
+	}
+	return strings.Join(quoted, " ")
+}
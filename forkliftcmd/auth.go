@@ -0,0 +1,58 @@
+package forkliftcmd
+
+import (
+	"sort"
+	"time"
+)
+
+const DefaultHMACMaxExpiry = 5 * time.Minute
+
+// Auth configures how remote callers authenticate, nothing configured lets everyone in.
+type Auth struct {
+	// TokensFile holds "<identity> <token>" lines for bearer tokens.
+	TokensFile string `json:"tokensFile,omitempty" yaml:"tokensFile,omitempty"`
+	// HMACKeysFile holds "<key id> <secret>" lines for signed requests.
+	HMACKeysFile string `json:"hmacKeysFile,omitempty" yaml:"hmacKeysFile,omitempty"`
+	// HMACMaxExpiry bounds how far in the future a signature may expire, like "5m" or in milliseconds.
+	HMACMaxExpiry time.Duration `json:"hmacMaxExpiry,omitempty" yaml:"hmacMaxExpiry,omitempty"`
+	// ClientCA is the PEM bundle client certificates must chain to.
+	ClientCA string `json:"clientCA,omitempty" yaml:"clientCA,omitempty"`
+	// AllowedOrigins are the browser origins allowed besides the server's own, "*" allows any.
+	AllowedOrigins []string `json:"allowedOrigins,omitempty" yaml:"allowedOrigins,omitempty"`
+	// Groups maps group names to their member identities, for the command ACLs.
+	Groups map[string][]string `json:"groups,omitempty" yaml:"groups,omitempty"`
+}
+
+type authConfig Auth
+
+func (a *Auth) UnmarshalJSON(b []byte) (err error) {
+	authUnmarshal := authConfig(*a)
+	if err = unmarshalConfig(b, &authUnmarshal); err != nil {
+		return err
+	}
+	*a = Auth(authUnmarshal)
+	return nil
+}
+
+func (a Auth) MarshalJSON() ([]byte, error) {
+	return marshalConfig(authConfig(a))
+}
+
+// GroupsOf returns the groups identity is a member of, sorted.
+func (a Auth) GroupsOf(identity string) []string {
+	var groups []string
+	for group, members := range a.Groups {
+		for _, member := range members {
+			if member == identity {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+func (a Auth) Enabled() bool {
+	return a.TokensFile != "" || a.HMACKeysFile != "" || a.ClientCA != ""
+}
@@ -0,0 +1,19 @@
+package forkliftcmd
+
+// Cgroup limits a command through a cgroup v2 created for each execution.
+// Values use the cgroup file formats, an empty Cgroup disables it.
+type Cgroup struct {
+	// CPUWeight is written to cpu.weight, 1 to 10000.
+	CPUWeight uint64 `json:"cpuWeight,omitempty" yaml:"cpuWeight,omitempty"`
+	// CPUMax is written to cpu.max, "$MAX $PERIOD" like "50000 100000".
+	CPUMax string `json:"cpuMax,omitempty" yaml:"cpuMax,omitempty"`
+	// MemoryMax is written to memory.max, bytes with an optional K, M or G suffix.
+	MemoryMax string `json:"memoryMax,omitempty" yaml:"memoryMax,omitempty"`
+	PidsMax   uint64 `json:"pidsMax,omitempty" yaml:"pidsMax,omitempty"`
+	// IOWeight is written to io.weight, 1 to 10000.
+	IOWeight uint64 `json:"ioWeight,omitempty" yaml:"ioWeight,omitempty"`
+}
+
+func (c Cgroup) IsZero() bool {
+	return c == Cgroup{}
+}
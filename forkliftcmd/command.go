@@ -1,10 +1,13 @@
 package forkliftcmd
 
 import (
+	"encoding/json"
+	"reflect"
 	"time"
 
 	"github.com/ahl5esoft/golang-underscore"
 	"github.com/ghodss/yaml"
+	"github.com/n0rad/go-erlog/errs"
 	"github.com/n0rad/go-erlog/logs"
 )
 
@@ -17,45 +20,163 @@ type forkliftCommandConfigSvc interface {
 	SetDefaultCommand(commandName string, commandCwd string) ForkliftCommand
 	findCommand(cmdName string, config interface{}) (configCmd ForkliftCommand)
 	FindLocalCommand(cmdName string) (configCmd ForkliftCommand)
-	FindRemoteCommand(cmdName string) (configCmd ForkliftCommand)
+	FindRemoteCommand(cmdName string) (configCmd ForkliftCommand, found bool)
 }
 
 type ForkliftCommand struct {
-	Shortname    string        `json:"shortname",yaml:"shortname"`
-	Path         string        `json:"path",yaml:"path"`
-	Args         string        `json:"args,omitempty",yaml:"args,omitempty"`
-	Timeout      time.Duration `json:"timeout,omitempty",yaml:"timeout,omitempty"`
-	Cwd          string        `json:"cwd",yaml:"cwd"`
-	Oneshot      bool          `json:"oneshot",yaml:"oneshot"`
-	PostStopHook string        `json:"postStopHook,omitempty",yaml:"postStopHook,omitempty"`
+	Shortname        string            `json:"shortname" yaml:"shortname"`
+	Path             string            `json:"path" yaml:"path"`
+	Args             Args              `json:"args,omitempty" yaml:"args,omitempty"`
+	Timeout          time.Duration     `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Cwd              string            `json:"cwd" yaml:"cwd"`
+	Oneshot          bool              `json:"oneshot" yaml:"oneshot"`
+	PostStopHook     string            `json:"postStopHook,omitempty" yaml:"postStopHook,omitempty"`
+	StopSignal       string            `json:"stopSignal,omitempty" yaml:"stopSignal,omitempty"`
+	StopGracePeriod  time.Duration     `json:"stopGracePeriod,omitempty" yaml:"stopGracePeriod,omitempty"`
+	ReapOrphans      bool              `json:"reapOrphans,omitempty" yaml:"reapOrphans,omitempty"`
+	Restart          string            `json:"restart,omitempty" yaml:"restart,omitempty"`
+	MaxRetries       *int              `json:"maxRetries,omitempty" yaml:"maxRetries,omitempty"`
+	RestartWindow    time.Duration     `json:"restartWindow,omitempty" yaml:"restartWindow,omitempty"`
+	Backoff          time.Duration     `json:"backoff,omitempty" yaml:"backoff,omitempty"`
+	MaxBackoff       time.Duration     `json:"maxBackoff,omitempty" yaml:"maxBackoff,omitempty"`
+	SuccessExitCodes []int             `json:"successExitCodes,omitempty" yaml:"successExitCodes,omitempty"`
+	Critical         bool              `json:"critical,omitempty" yaml:"critical,omitempty"`
+	Env              map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	EnvFile          []string          `json:"envFile,omitempty" yaml:"envFile,omitempty"`
+	ClearEnv         bool              `json:"clearEnv,omitempty" yaml:"clearEnv,omitempty"`
+	InheritEnv       []string          `json:"inheritEnv,omitempty" yaml:"inheritEnv,omitempty"`
+	RemoteEnv        []string          `json:"remoteEnv,omitempty" yaml:"remoteEnv,omitempty"`
+	User             string            `json:"user,omitempty" yaml:"user,omitempty"`
+	Group            string            `json:"group,omitempty" yaml:"group,omitempty"`
+	Groups           []string          `json:"groups,omitempty" yaml:"groups,omitempty"`
+	Umask            string            `json:"umask,omitempty" yaml:"umask,omitempty"`
+	Rlimits          Rlimits           `json:"rlimits,omitempty" yaml:"rlimits,omitempty"`
+	Cgroup           Cgroup            `json:"cgroup,omitempty" yaml:"cgroup,omitempty"`
+	TTY              bool              `json:"tty,omitempty" yaml:"tty,omitempty"`
+	AllowArgs        bool              `json:"allowArgs,omitempty" yaml:"allowArgs,omitempty"`
+	ACL              []ACLRule         `json:"acl,omitempty" yaml:"acl,omitempty"`
+	Params           []Param           `json:"params,omitempty" yaml:"params,omitempty"`
+	ArgsTemplate     []string          `json:"argsTemplate,omitempty" yaml:"argsTemplate,omitempty"`
+	HealthCheck      *HealthCheck      `json:"healthCheck,omitempty" yaml:"healthCheck,omitempty"`
+	Source           string            `json:"-" yaml:"-"`
+	secrets          []string
 }
 
 type ForkliftCommandConfig struct {
 	defaultCommand ForkliftCommand
 	LocalConfig    []ForkliftCommand `json:"command,omitempty"`
 	RemoteConfig   []ForkliftCommand `json:"remoteCommand,omitempty"`
+	Auth           Auth              `json:"auth,omitempty"`
+	Include        []string          `json:"include,omitempty"`
+	// lines are the lines of the commands of each section in the file they were read from
+	lines map[string][]int
+	// files are the files and directories read by LoadConfig
+	files []string
+}
+
+// configFile is the layout of a config file, its commands are decoded one by one to locate their errors.
+type configFile struct {
+	Command       []json.RawMessage `json:"command"`
+	RemoteCommand []json.RawMessage `json:"remoteCommand"`
+	Auth          json.RawMessage   `json:"auth"`
+	Include       []string          `json:"include"`
 }
 
 func (fc *ForkliftCommand) UnmarshalJSON(b []byte) (err error) {
 	fcConfigUnmarshal := fcConfig(*fc)
-	if yaml.Unmarshal(b, &fcConfigUnmarshal) != nil {
+	if err = unmarshalConfig(b, &fcConfigUnmarshal); err != nil {
+		return err
+	}
+	if err = fcConfigUnmarshal.interpolate(); err != nil {
+		return err
+	}
+	if _, err = ParseSignal(fcConfigUnmarshal.StopSignal); err != nil {
+		return err
+	}
+	if _, err = ParseRestartPolicy(fcConfigUnmarshal.Restart); err != nil {
+		return err
+	}
+	if _, err = ParseUmask(fcConfigUnmarshal.Umask); err != nil {
+		return err
+	}
+	if err = validateACL(fcConfigUnmarshal.ACL); err != nil {
+		return err
+	}
+	if err = validateParams(fcConfigUnmarshal); err != nil {
 		return err
 	}
-	fcConfigUnmarshal.Timeout = fcConfigUnmarshal.Timeout * time.Millisecond
 	na := ForkliftCommand(fcConfigUnmarshal)
 	*fc = na
 	return nil
 }
 
+func (fc ForkliftCommand) MarshalJSON() ([]byte, error) {
+	return marshalConfig(fcConfig(fc))
+}
+
+// AllowsRemoteEnv tells if a remote exec request may set the variable name,
+// RemoteEnv lists the allowed names, "*" allows any.
+func (fc ForkliftCommand) AllowsRemoteEnv(name string) bool {
+	for _, allowed := range fc.RemoteEnv {
+		if allowed == "*" || allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
 func MapConfigFile(fileContent []byte) (config ForkliftCommandConfig, err error) {
 	if len(fileContent) < 1 {
 		return config, nil
 	}
-	err = yaml.Unmarshal(fileContent, &config)
-	logs.WithField("config", config).
-		WithField("fileContent", string(fileContent)).
-		Debug("Loading Command config")
-	return config, err
+	logs.WithField("fileContent", string(fileContent)).Debug("Loading Command config")
+	jsonContent, err := yaml.YAMLToJSON(fileContent)
+	if err != nil {
+		return config, errs.WithE(err, "Invalid yaml")
+	}
+	var document interface{}
+	var file configFile
+	if err = json.Unmarshal(jsonContent, &document); err != nil {
+		return config, errs.WithE(err, "Invalid yaml")
+	}
+	if _, ok := document.(map[string]interface{}); !ok && document != nil {
+		return config, errs.With("Config file must be a mapping")
+	}
+	source := newConfigSource(fileContent)
+	if err = source.checkKeys(document, reflect.TypeOf(config), nil).err("Unknown config keys"); err != nil {
+		return config, err
+	}
+	if err = json.Unmarshal(jsonContent, &file); err != nil {
+		return config, source.errorAt(err)
+	}
+	for i, command := range file.Command {
+		var fc ForkliftCommand
+		if err = json.Unmarshal(command, &fc); err != nil {
+			return config, source.errorAt(err, "command", i)
+		}
+		config.LocalConfig = append(config.LocalConfig, fc)
+	}
+	for i, command := range file.RemoteCommand {
+		var fc ForkliftCommand
+		if err = json.Unmarshal(command, &fc); err != nil {
+			return config, source.errorAt(err, "remoteCommand", i)
+		}
+		config.RemoteConfig = append(config.RemoteConfig, fc)
+	}
+	if len(file.Auth) > 0 && string(file.Auth) != "null" {
+		if err = json.Unmarshal(file.Auth, &config.Auth); err != nil {
+			return config, source.errorAt(err, "auth")
+		}
+	}
+	config.Include = file.Include
+	config.lines = map[string][]int{}
+	for _, section := range config.sections() {
+		for i := range section.commands {
+			config.lines[section.key] = append(config.lines[section.key], source.Line(section.key, i))
+		}
+	}
+	logs.WithField("config", config).Debug("Loaded Command config")
+	return config, nil
 }
 
 func NewForkliftCommandConfig() ForkliftCommandConfig {
@@ -91,7 +212,12 @@ func (cfg *ForkliftCommandConfig) FindLocalCommand(cmdName string) (configCmd Fo
 	return cfg.findCommand(cmdName, tmpConfigRemoteCmd)
 }
 
-func (cfg *ForkliftCommandConfig) FindRemoteCommand(cmdName string) (configCmd ForkliftCommand) {
+// FindRemoteCommand finds the remote command named cmdName. Remote callers may only
+// run the configured commands, there is no fallback to the default command.
+func (cfg *ForkliftCommandConfig) FindRemoteCommand(cmdName string) (configCmd ForkliftCommand, found bool) {
 	tmpConfigRemoteCmd := underscore.FindBy(cfg.RemoteConfig, map[string]interface{}{"shortname": cmdName})
-	return cfg.findCommand(cmdName, tmpConfigRemoteCmd)
+	if cmdName == "" || tmpConfigRemoteCmd == nil {
+		return configCmd, false
+	}
+	return tmpConfigRemoteCmd.(ForkliftCommand), true
 }
@@ -1,8 +1,16 @@
 package forkliftcmd
 
 import (
+	"fmt"
+	"github.com/ghodss/yaml"
+	"github.com/mgutz/str"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -105,7 +113,7 @@ func TestFindLocalCommandConfig(t *testing.T) {
 
 func TestFindRemoteCommandConfig(t *testing.T) {
 	config := NewForkliftCommandConfig()
-	defaultCmd := config.SetDefaultCommand("defaultName", "defaultCwd")
+	config.SetDefaultCommand("defaultName", "defaultCwd")
 	config.RemoteConfig = []ForkliftCommand{
 		{
 			Shortname: "ls",
@@ -128,15 +136,18 @@ func TestFindRemoteCommandConfig(t *testing.T) {
 	}{
 		{config.RemoteConfig[0].Shortname, config.RemoteConfig[0]},
 		{config.RemoteConfig[1].Shortname, config.RemoteConfig[1]},
-		{"", defaultCmd},
-		{"no_match", defaultCmd},
+		{"", ForkliftCommand{}},
+		{"no_match", ForkliftCommand{}},
 	}
 	for _, tt := range matchTests {
-		foundCmd := config.FindRemoteCommand(tt.cmdName)
+		foundCmd, found := config.FindRemoteCommand(tt.cmdName)
 		t.Logf("Testing %q", tt.cmdName)
 		if !reflect.DeepEqual(tt.out, foundCmd) {
 			t.Errorf("FindRemoteCommand(%q) should return %v", tt.cmdName, tt.out)
 		}
+		if found != (tt.out.Path != "") {
+			t.Errorf("FindRemoteCommand(%q) found should be %v, unknown names don't fall back to the default command", tt.cmdName, !found)
+		}
 	}
 
 }
@@ -177,3 +188,525 @@ func TestFindCommandMatchConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestMapConfigFileStopSequence(t *testing.T) {
+	config, err := MapConfigFile([]byte("command:\n- shortname: test\n  path: /bin/test\n  stopSignal: SIGQUIT\n  stopGracePeriod: 2500"))
+	assert.NoError(t, err, "Stop sequence should be accepted")
+	if assert.Len(t, config.LocalConfig, 1) {
+		assert.Equal(t, "SIGQUIT", config.LocalConfig[0].StopSignal)
+		assert.Equal(t, 2500*time.Millisecond, config.LocalConfig[0].StopGracePeriod)
+	}
+}
+
+func TestMapConfigFileUnknownStopSignal(t *testing.T) {
+	_, err := MapConfigFile([]byte("command:\n- shortname: test\n  path: /bin/test\n  stopSignal: SIGNOPE"))
+	assert.Error(t, err, "Unknown stop signal should throw an error")
+}
+
+func TestParseSignal(t *testing.T) {
+	var signalTests = []struct {
+		name string
+		out  syscall.Signal
+	}{
+		{"", syscall.SIGTERM},
+		{"SIGINT", syscall.SIGINT},
+		{"quit", syscall.SIGQUIT},
+		{"USR1", syscall.SIGUSR1},
+		{"9", syscall.SIGKILL},
+	}
+	for _, tt := range signalTests {
+		sig, err := ParseSignal(tt.name)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.out, sig, "ParseSignal(%q)", tt.name)
+	}
+	_, err := ParseSignal("SIGNOPE")
+	assert.Error(t, err, "Unknown signal should throw an error")
+}
+
+func TestMapConfigFileRestartPolicy(t *testing.T) {
+	config, err := MapConfigFile([]byte("command:\n- shortname: test\n  path: /bin/test\n  restart: on-failure\n  maxRetries: 5\n  restartWindow: 60000\n  backoff: 200\n  maxBackoff: 5000\n  successExitCodes: [0, 2]"))
+	assert.NoError(t, err, "Restart policy should be accepted")
+	if assert.Len(t, config.LocalConfig, 1) {
+		cmd := config.LocalConfig[0]
+		assert.Equal(t, RestartOnFailure, cmd.Restart)
+		if assert.NotNil(t, cmd.MaxRetries) {
+			assert.Equal(t, 5, *cmd.MaxRetries)
+		}
+		assert.Equal(t, time.Minute, cmd.RestartWindow)
+		assert.Equal(t, 200*time.Millisecond, cmd.Backoff)
+		assert.Equal(t, 5*time.Second, cmd.MaxBackoff)
+		assert.Equal(t, []int{0, 2}, cmd.SuccessExitCodes)
+	}
+	_, err = MapConfigFile([]byte("command:\n- shortname: test\n  restart: sometimes"))
+	assert.Error(t, err, "Unknown restart policy should throw an error")
+}
+
+func TestMapConfigFileEnv(t *testing.T) {
+	config, err := MapConfigFile([]byte("remoteCommand:\n- shortname: test\n  path: /bin/test\n  env:\n    FOO: bar\n  envFile: [/etc/test.env]\n  clearEnv: true\n  inheritEnv: [PATH]\n  remoteEnv: [DEBUG]"))
+	assert.NoError(t, err, "Env settings should be accepted")
+	if assert.Len(t, config.RemoteConfig, 1) {
+		cmd := config.RemoteConfig[0]
+		assert.Equal(t, map[string]string{"FOO": "bar"}, cmd.Env)
+		assert.Equal(t, []string{"/etc/test.env"}, cmd.EnvFile)
+		assert.True(t, cmd.ClearEnv)
+		assert.Equal(t, []string{"PATH"}, cmd.InheritEnv)
+		assert.True(t, cmd.AllowsRemoteEnv("DEBUG"))
+		assert.False(t, cmd.AllowsRemoteEnv("LD_PRELOAD"))
+	}
+	assert.True(t, ForkliftCommand{RemoteEnv: []string{"*"}}.AllowsRemoteEnv("ANY"))
+	assert.False(t, ForkliftCommand{}.AllowsRemoteEnv("ANY"), "Remote env is denied by default")
+}
+
+func TestMapConfigFileUserAndLimits(t *testing.T) {
+	config, err := MapConfigFile([]byte("remoteCommand:\n- shortname: test\n  path: /bin/test\n  user: nobody\n  group: nogroup\n  groups: [adm]\n  umask: \"027\"\n  rlimits:\n    nofile: 1024\n    nproc: 64\n    cpu: 60\n    as: 1073741824"))
+	assert.NoError(t, err, "User and limits should be accepted")
+	if assert.Len(t, config.RemoteConfig, 1) {
+		cmd := config.RemoteConfig[0]
+		assert.Equal(t, "nobody", cmd.User)
+		assert.Equal(t, "nogroup", cmd.Group)
+		assert.Equal(t, []string{"adm"}, cmd.Groups)
+		assert.Equal(t, Rlimits{NoFile: 1024, NProc: 64, CPU: 60, AS: 1 << 30}, cmd.Rlimits)
+	}
+	_, err = MapConfigFile([]byte("remoteCommand:\n- shortname: test\n  umask: \"999\""))
+	assert.Error(t, err, "Invalid umask should throw an error")
+}
+
+func TestParseUmask(t *testing.T) {
+	mask, err := ParseUmask("")
+	assert.NoError(t, err)
+	assert.Equal(t, -1, mask)
+	mask, err = ParseUmask("0022")
+	assert.NoError(t, err)
+	assert.Equal(t, 022, mask)
+	_, err = ParseUmask("1777")
+	assert.Error(t, err)
+}
+
+func TestMapConfigFileCgroup(t *testing.T) {
+	config, err := MapConfigFile([]byte("remoteCommand:\n- shortname: test\n  path: /bin/test\n  cgroup:\n    cpuWeight: 50\n    cpuMax: 50000 100000\n    memoryMax: 512M\n    pidsMax: 128\n    ioWeight: 10"))
+	assert.NoError(t, err, "Cgroup limits should be accepted")
+	if assert.Len(t, config.RemoteConfig, 1) {
+		assert.Equal(t, Cgroup{CPUWeight: 50, CPUMax: "50000 100000", MemoryMax: "512M", PidsMax: 128, IOWeight: 10}, config.RemoteConfig[0].Cgroup)
+		assert.False(t, config.RemoteConfig[0].Cgroup.IsZero())
+	}
+}
+
+func TestMapConfigFileTTY(t *testing.T) {
+	config, err := MapConfigFile([]byte("remoteCommand:\n- shortname: shell\n  path: /bin/sh\n  tty: true"))
+	assert.NoError(t, err)
+	if assert.Len(t, config.RemoteConfig, 1) {
+		assert.True(t, config.RemoteConfig[0].TTY)
+	}
+}
+
+func TestMapConfigFileAllowArgs(t *testing.T) {
+	config, err := MapConfigFile([]byte("remoteCommand:\n- shortname: shell\n  path: /bin/sh\n  allowArgs: true\n- shortname: ls\n  path: /bin/ls"))
+	assert.NoError(t, err)
+	if assert.Len(t, config.RemoteConfig, 2) {
+		assert.True(t, config.RemoteConfig[0].AllowArgs)
+		assert.False(t, config.RemoteConfig[1].AllowArgs, "Client args should be refused by default")
+	}
+}
+
+func TestSignalName(t *testing.T) {
+	assert.Equal(t, "SIGTERM", SignalName(syscall.SIGTERM))
+	assert.Equal(t, "SIGKILL", SignalName(syscall.SIGKILL))
+	assert.Equal(t, "31", SignalName(syscall.Signal(31)))
+}
+
+func TestMapConfigFileAuth(t *testing.T) {
+	config, err := MapConfigFile([]byte("auth:\n  tokensFile: /etc/forklift/tokens\n  hmacKeysFile: /etc/forklift/keys\n  hmacMaxExpiry: 60000\n  clientCA: /etc/forklift/ca.pem\n  allowedOrigins:\n  - https://ops.example.com"))
+	assert.NoError(t, err)
+	assert.Equal(t, Auth{
+		TokensFile:     "/etc/forklift/tokens",
+		HMACKeysFile:   "/etc/forklift/keys",
+		HMACMaxExpiry:  time.Minute,
+		ClientCA:       "/etc/forklift/ca.pem",
+		AllowedOrigins: []string{"https://ops.example.com"},
+	}, config.Auth)
+	assert.True(t, config.Auth.Enabled())
+}
+
+func TestMapConfigFileACL(t *testing.T) {
+	config, err := MapConfigFile([]byte("remoteCommand:\n- shortname: deploy\n  path: /bin/deploy\n  acl:\n  - identities: [ci]\n    actions: [exec, attach]\n  - groups: [ops]\n    actions: [\"*\"]\nauth:\n  groups:\n    ops: [alice, bob]\n    dev: [bob]"))
+	assert.NoError(t, err)
+	if assert.Len(t, config.RemoteConfig, 1) {
+		cmd := config.RemoteConfig[0]
+		assert.True(t, cmd.Allows("ci", nil, ActionExec))
+		assert.False(t, cmd.Allows("ci", nil, ActionKill))
+		assert.True(t, cmd.Allows("alice", config.Auth.GroupsOf("alice"), ActionKill))
+		assert.False(t, cmd.Allows("mallory", nil, ActionExec))
+		assert.False(t, cmd.Allows("", nil, ActionExec), "Anonymous callers should not match identities")
+	}
+	assert.Equal(t, []string{"dev", "ops"}, config.Auth.GroupsOf("bob"))
+	assert.True(t, ForkliftCommand{}.Allows("", nil, ActionKill), "Commands without acl allow everything")
+	assert.True(t, ForkliftCommand{ACL: []ACLRule{{Identities: []string{AnyIdentity}, Actions: []string{ActionArgs}}}}.Allows("ci", nil, ActionArgs))
+
+	_, err = MapConfigFile([]byte("remoteCommand:\n- shortname: deploy\n  acl:\n  - identities: [ci]\n    actions: [reboot]"))
+	assert.Error(t, err, "Unknown acl action should throw an error")
+}
+
+func TestMapConfigFileParams(t *testing.T) {
+	config, err := MapConfigFile([]byte(`remoteCommand:
+- shortname: deploy
+  path: /bin/deploy
+  params:
+  - name: env
+    type: enum
+    enum: [staging, production]
+    required: true
+  - name: replicas
+    type: int
+    default: 2
+  - name: force
+    type: bool
+  - name: manifest
+    type: path
+    root: /srv/manifests
+    default: app.yml
+  - name: tag
+    pattern: "[a-z0-9.]+"
+  argsTemplate: ["--env={{.env}}", "--replicas={{.replicas}}", "{{if .force}}--force{{end}}", "{{.manifest}}", "{{.tag}}"]`))
+	assert.NoError(t, err)
+	if !assert.Len(t, config.RemoteConfig, 1) {
+		return
+	}
+	cmd := config.RemoteConfig[0]
+	assert.True(t, cmd.Templated())
+
+	args, err := cmd.RenderArgs(map[string]string{"env": "staging", "force": "true", "tag": "v1.2"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--env=staging", "--replicas=2", "--force", "/srv/manifests/app.yml", "v1.2"}, args)
+	args, err = cmd.RenderArgs(map[string]string{"env": "production", "manifest": "/srv/manifests/a/b.yml"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--env=production", "--replicas=2", "/srv/manifests/a/b.yml"}, args, "Empty args should be dropped")
+
+	invalid := []map[string]string{
+		{},
+		{"env": "dev"},
+		{"env": "staging", "replicas": "two"},
+		{"env": "staging", "force": "maybe"},
+		{"env": "staging", "manifest": "../../etc/passwd"},
+		{"env": "staging", "tag": "--exec=sh"},
+		{"env": "staging", "other": "x"},
+	}
+	for _, params := range invalid {
+		_, err = cmd.RenderArgs(params)
+		assert.Error(t, err, "%v should be rejected", params)
+	}
+
+	for _, conf := range []string{
+		"  params:\n  - name: x\n    type: float",
+		"  params:\n  - name: x\n    type: enum",
+		"  params:\n  - name: x\n  - name: x",
+		"  params:\n  - name: x-y",
+		"  params:\n  - name: x\n    pattern: \"[\"",
+		"  params:\n  - name: x\n    type: int\n    default: abc",
+		"  args: -v\n  argsTemplate: [\"{{.x}}\"]",
+		"  argsTemplate: [\"{{.x\"]",
+		"  allowArgs: true\n  params:\n  - name: x",
+	} {
+		_, err = MapConfigFile([]byte("remoteCommand:\n- shortname: deploy\n  path: /bin/deploy\n" + conf))
+		assert.Error(t, err, conf)
+	}
+}
+
+func TestParamValue(t *testing.T) {
+	_, err := Param{Name: "name"}.value("-rf")
+	assert.Error(t, err, "Values looking like flags should be rejected without pattern")
+	value, err := Param{Name: "name", Pattern: "-?[a-z]+"}.value("-rf")
+	assert.NoError(t, err)
+	assert.Equal(t, "-rf", value)
+	value, err = Param{Name: "file", Type: ParamPath}.value("logs//app.log")
+	assert.NoError(t, err)
+	assert.Equal(t, "logs/app.log", value)
+	_, err = Param{Name: "file", Type: ParamPath}.value("logs/../../app.log")
+	assert.Error(t, err)
+}
+
+func TestMapConfigFileHealthCheck(t *testing.T) {
+	config, err := MapConfigFile([]byte("command:\n- shortname: web\n  path: /bin/web\n  healthCheck:\n    http: http://localhost:8080/health\n    interval: 5000\n- shortname: db\n  path: /bin/db\n  healthCheck:\n    tcp: localhost:5432\n    timeout: 200\n    threshold: 1"))
+	assert.NoError(t, err)
+	if assert.Len(t, config.LocalConfig, 2) {
+		assert.Equal(t, &HealthCheck{HTTP: "http://localhost:8080/health", Interval: 5 * time.Second, Timeout: DefaultHealthTimeout, Threshold: DefaultHealthThreshold}, config.LocalConfig[0].HealthCheck)
+		assert.Equal(t, &HealthCheck{TCP: "localhost:5432", Interval: DefaultHealthInterval, Timeout: 200 * time.Millisecond, Threshold: 1}, config.LocalConfig[1].HealthCheck)
+	}
+	for _, check := range []string{"interval: 10", "tcp: a:1\nhttp: http://a", "tcp: a:1\nthreshold: -1"} {
+		_, err = MapConfigFile([]byte("command:\n- shortname: web\n  path: /bin/web\n  healthCheck:\n    " + strings.Replace(check, "\n", "\n    ", -1)))
+		assert.Error(t, err, check)
+	}
+}
+
+func TestMapConfigFileUnknownKeys(t *testing.T) {
+	_, err := MapConfigFile([]byte("remoteCommand:\n- shortname: test\n  path: /bin/test\n  timout: 10\n  healthCheck:\n    tcp: localhost:1\n    intervall: 5\nauthh:\n  tokensFile: /etc/tokens"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "problems=3")
+		assert.Contains(t, err.Error(), "key=remoteCommand[0].timout")
+		assert.Contains(t, err.Error(), "line=4")
+		assert.Contains(t, err.Error(), "key=remoteCommand[0].healthCheck.intervall")
+		assert.Contains(t, err.Error(), "line=7")
+		assert.Contains(t, err.Error(), "key=authh")
+		assert.Contains(t, err.Error(), "line=8")
+	}
+	_, err = MapConfigFile([]byte("command:\n- shortname: test\n  path: /bin/test\n  env:\n    ANY_NAME: value\n  rlimits:\n    nofile: 10"))
+	assert.NoError(t, err, "Map keys and nested structs should be accepted")
+}
+
+func TestMapConfigFileErrorLine(t *testing.T) {
+	_, err := MapConfigFile([]byte("command:\n- shortname: a\n  path: /bin/a\n- shortname: b\n  path: /bin/b\n  timeout: abc"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "at=command[1].timeout")
+		assert.Contains(t, err.Error(), "line=6")
+	}
+	_, err = MapConfigFile([]byte("command:\n- shortname: a\n  path: /bin/a\n  oneshot: maybe"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "at=command[0].oneshot")
+		assert.Contains(t, err.Error(), "line=4")
+	}
+	_, err = MapConfigFile([]byte("remoteCommand:\n- shortname: a\n  path: /bin/a\n\n# second\n- shortname: b\n  path: /bin/b\n  stopSignal: SIGNOPE"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "at=remoteCommand[1]")
+		assert.Contains(t, err.Error(), "line=6")
+	}
+}
+
+func TestConfigSourceLine(t *testing.T) {
+	source := newConfigSource([]byte("# comment\ncommand:\n- shortname: a\n  path: /bin/a\n  healthCheck:\n    exec:\n      - /bin/check\n-\n  shortname: b\nremoteCommand:\n  - shortname: c\n    env:\n      A: b\n  - shortname: d\n"))
+	assert.Equal(t, 2, source.Line("command"))
+	assert.Equal(t, 3, source.Line("command", 0))
+	assert.Equal(t, 4, source.Line("command", 0, "path"))
+	assert.Equal(t, 7, source.Line("command", 0, "healthCheck", "exec", 0))
+	assert.Equal(t, 9, source.Line("command", 1, "shortname"))
+	assert.Equal(t, 13, source.Line("remoteCommand", 0, "env", "A"))
+	assert.Equal(t, 14, source.Line("remoteCommand", 1, "shortname"))
+	assert.Equal(t, 11, source.Line("remoteCommand", 0, "path"), "Missing keys should get the line of their parent")
+	assert.Equal(t, 0, (*configSource)(nil).Line("command"))
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forklift-validate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "run.sh")
+	assert.NoError(t, ioutil.WriteFile(script, []byte("#!/bin/sh\n"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "data"), nil, 0644))
+
+	config, err := MapConfigFile([]byte("command:\n- shortname: a\n  path: " + script + "\n  cwd: " + dir + "\n- path: ./run.sh\n  cwd: " + dir + "\nremoteCommand:\n- shortname: a\n  path: sh\n  timeout: 1000"))
+	assert.NoError(t, err)
+	assert.NoError(t, config.Validate())
+
+	config, err = MapConfigFile([]byte("command:\n- shortname: a\n  path: " + script + "\n- shortname: a\n  path: " + filepath.Join(dir, "data") + "\n  cwd: " + filepath.Join(dir, "missing") + "\n  backoff: 5000\n  maxBackoff: 1000\nremoteCommand:\n- path: " + script + "\n  timeout: -1\n- shortname: b\n  healthCheck:\n    tcp: localhost:1\n    interval: 100\n    timeout: 200"))
+	assert.NoError(t, err)
+	err = config.Validate()
+	if assert.Error(t, err) {
+		for _, problem := range []string{"Duplicate command name", "Command path is not executable", "Command cwd is not a directory",
+			"Backoff is above maxBackoff", "Remote command needs a shortname", "Duration can't be negative", "Command needs a path",
+			"Health check timeout is above its interval", "line=4", "line=10", "line=12"} {
+			assert.Contains(t, err.Error(), problem)
+		}
+		assert.Contains(t, err.Error(), "problems=8")
+	}
+	assert.NoError(t, NewForkliftCommandConfig().Validate())
+}
+
+func TestMapConfigFileDurations(t *testing.T) {
+	config, err := MapConfigFile([]byte("command:\n- shortname: test\n  path: /bin/test\n  timeout: 30s\n  stopGracePeriod: 1500\n  restartWindow: \"2000\"\n  backoff: 1m30s\n  healthCheck:\n    tcp: localhost:1\n    interval: 5m\n    timeout: 250\nauth:\n  hmacMaxExpiry: 2m"))
+	assert.NoError(t, err)
+	if assert.Len(t, config.LocalConfig, 1) {
+		command := config.LocalConfig[0]
+		assert.Equal(t, 30*time.Second, command.Timeout)
+		assert.Equal(t, 1500*time.Millisecond, command.StopGracePeriod, "Integers should be milliseconds")
+		assert.Equal(t, 2*time.Second, command.RestartWindow)
+		assert.Equal(t, 90*time.Second, command.Backoff)
+		assert.Equal(t, 5*time.Minute, command.HealthCheck.Interval)
+		assert.Equal(t, 250*time.Millisecond, command.HealthCheck.Timeout)
+	}
+	assert.Equal(t, 2*time.Minute, config.Auth.HMACMaxExpiry)
+	for _, conf := range []string{"timeout: 30 seconds", "timeout: [1]", "healthCheck:\n    tcp: a:1\n    interval: -5s"} {
+		_, err = MapConfigFile([]byte("command:\n- shortname: test\n  path: /bin/test\n  " + conf))
+		assert.Error(t, err, conf)
+	}
+}
+
+func TestMapConfigFileArgs(t *testing.T) {
+	config, err := MapConfigFile([]byte("command:\n- shortname: list\n  path: /bin/sh\n  args:\n  - -c\n  - echo \"it's\" 'quoted'\n  - 10\n- shortname: string\n  path: /bin/sh\n  args: -c 'echo hello'\n- shortname: number\n  path: /bin/sleep\n  args: 100"))
+	assert.NoError(t, err)
+	if assert.Len(t, config.LocalConfig, 3) {
+		assert.Equal(t, Args{"-c", `echo "it's" 'quoted'`, "10"}, config.LocalConfig[0].Args)
+		assert.Equal(t, Args{"-c", "echo hello"}, config.LocalConfig[1].Args)
+		assert.Equal(t, Args{"100"}, config.LocalConfig[2].Args)
+	}
+	_, err = MapConfigFile([]byte("command:\n- shortname: test\n  path: /bin/sh\n  args:\n  - [-c]"))
+	assert.Error(t, err)
+}
+
+func TestArgsString(t *testing.T) {
+	args := Args{"-l", "a b", "it's", ""}
+	assert.Equal(t, `-l 'a b' "it's" ''`, args.String())
+	assert.Equal(t, []string(args), str.ToArgv(args.String()))
+}
+
+func TestMapConfigFileRoundTrip(t *testing.T) {
+	config, err := MapConfigFile([]byte("command:\n- shortname: test\n  path: /bin/sh\n  args: [-c, \"echo 'a b'\"]\n  timeout: 1m30s\n  backoff: 1500\n  healthCheck:\n    exec: [/bin/true]\n    interval: 2s\nremoteCommand:\n- shortname: remote\n  path: /bin/ls\n  args: -l -a\n  stopGracePeriod: 250ms\nauth:\n  tokensFile: /etc/tokens\n  hmacMaxExpiry: 1m"))
+	assert.NoError(t, err)
+	content, err := yaml.Marshal(config)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "timeout: 1m30s")
+	reread, err := MapConfigFile(content)
+	assert.NoError(t, err)
+	assert.Equal(t, config.LocalConfig, reread.LocalConfig)
+	assert.Equal(t, config.RemoteConfig, reread.RemoteConfig)
+	assert.Equal(t, config.Auth, reread.Auth)
+}
+
+func writeConfigFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func TestLoadConfigDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigFiles(t, dir, map[string]string{
+		"b.yml":          "remoteCommand:\n- shortname: b\n  path: /bin/ls\n",
+		"a.yml":          "command:\n- shortname: a\n  path: /bin/sh\nauth:\n  tokensFile: /etc/tokens\n",
+		"ignored.txt":    "not: yaml: at all",
+		"teams/c.yml":    "remoteCommand:\n- shortname: c\n  path: /bin/ls\n",
+		"a.yml.disabled": "remoteCommand: []",
+	})
+	config, err := LoadConfig(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, config.Validate())
+	if assert.Len(t, config.LocalConfig, 1) && assert.Len(t, config.RemoteConfig, 1) {
+		assert.Equal(t, filepath.Join(dir, "a.yml"), config.LocalConfig[0].Source)
+		assert.Equal(t, filepath.Join(dir, "b.yml"), config.RemoteConfig[0].Source)
+	}
+	assert.Equal(t, "/etc/tokens", config.Auth.TokensFile)
+	assert.Equal(t, []string{dir, filepath.Join(dir, "a.yml"), filepath.Join(dir, "b.yml")}, config.Files())
+}
+
+func TestLoadConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigFiles(t, dir, map[string]string{
+		"config.yml":       "include: [conf.d/*.yml, common.yml]\nremoteCommand:\n- shortname: main\n  path: /bin/ls\n",
+		"conf.d/team1.yml": "remoteCommand:\n- shortname: one\n  path: /bin/ls\ninclude: [../common.yml]\n",
+		"conf.d/team2.yml": "remoteCommand:\n- shortname: two\n  path: /bin/ls\n",
+		"common.yml":       "command:\n- shortname: common\n  path: /bin/sh\n",
+	})
+	config, err := LoadConfig(filepath.Join(dir, "config.yml"))
+	assert.NoError(t, err)
+	assert.NoError(t, config.Validate(), "Files included twice should be loaded once")
+	var names []string
+	for _, command := range config.RemoteConfig {
+		names = append(names, command.Shortname)
+	}
+	assert.Equal(t, []string{"main", "one", "two"}, names)
+	if assert.Len(t, config.LocalConfig, 1) {
+		assert.Equal(t, filepath.Join(dir, "conf.d", "..", "common.yml"), config.LocalConfig[0].Source)
+	}
+
+	_, err = LoadConfig(filepath.Join(dir, "conf.d"))
+	assert.NoError(t, err)
+	writeConfigFiles(t, dir, map[string]string{"broken.yml": "include: [missing.yml]\n"})
+	_, err = LoadConfig(filepath.Join(dir, "broken.yml"))
+	assert.Error(t, err)
+	writeConfigFiles(t, dir, map[string]string{"invalid/a.yml": "remoteCommand:\n- shortname: a\n  path: /bin/ls\n  timout: 1\n"})
+	_, err = LoadConfig(filepath.Join(dir, "invalid"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "file="+filepath.Join(dir, "invalid", "a.yml"))
+		assert.Contains(t, err.Error(), "line=4")
+	}
+}
+
+func TestLoadConfigCollisions(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigFiles(t, dir, map[string]string{
+		"a.yml": "remoteCommand:\n- shortname: deploy\n  path: /bin/ls\ncommand:\n- shortname: deploy\n  path: /bin/sh\n",
+		"b.yml": "\nremoteCommand:\n- shortname: deploy\n  path: /bin/sh\n",
+	})
+	config, err := LoadConfig(dir)
+	assert.NoError(t, err)
+	err = config.Validate()
+	if assert.Error(t, err, "Commands of the same section should not share a name") {
+		assert.Contains(t, err.Error(), "problems=1")
+		assert.Contains(t, err.Error(), "Duplicate command name")
+		assert.Contains(t, err.Error(), "file="+filepath.Join(dir, "b.yml"))
+		assert.Contains(t, err.Error(), "line=3")
+		assert.Contains(t, err.Error(), "definedAt="+filepath.Join(dir, "a.yml")+":2")
+	}
+
+	writeConfigFiles(t, dir, map[string]string{
+		"a.yml": "auth:\n  tokensFile: /etc/a\n",
+		"b.yml": "auth:\n  tokensFile: /etc/b\n",
+	})
+	_, err = LoadConfig(dir)
+	assert.Error(t, err, "Auth should be defined once")
+}
+
+func TestDiffCommandsIgnoresSource(t *testing.T) {
+	previous := []ForkliftCommand{{Shortname: "a", Path: "/bin/ls", Source: "a.yml"}, {Shortname: "b", Path: "/bin/ls", Source: "a.yml"}}
+	next := []ForkliftCommand{{Shortname: "a", Path: "/bin/ls", Source: "b.yml"}, {Shortname: "b", Path: "/bin/sh", Source: "a.yml"}}
+	added, changed, removed := DiffCommands(previous, next)
+	assert.Empty(t, added)
+	assert.Equal(t, []string{"b"}, changed)
+	assert.Empty(t, removed)
+}
+
+func TestMapConfigFileInterpolation(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, ioutil.WriteFile(secret, []byte("s3cr3t\n"), 0600))
+	t.Setenv("FORKLIFT_TEST_DIR", "/opt/app")
+	t.Setenv("FORKLIFT_TEST_EMPTY", "")
+	config, err := MapConfigFile([]byte("remoteCommand:\n- shortname: deploy\n  path: ${FORKLIFT_TEST_DIR}/bin/deploy\n  cwd: ${FORKLIFT_TEST_UNSET:-/tmp}\n  args: [--token, \"${file:" + secret + "}\", \"$${LITERAL}\", $HOME, \"${FORKLIFT_TEST_EMPTY}\"]\n  env:\n    TOKEN: ${file:" + secret + "}\n    LEVEL: ${FORKLIFT_TEST_EMPTY:-info}\n  envFile: [\"${FORKLIFT_TEST_DIR}/env\"]"))
+	assert.NoError(t, err)
+	if assert.Len(t, config.RemoteConfig, 1) {
+		command := config.RemoteConfig[0]
+		assert.Equal(t, "/opt/app/bin/deploy", command.Path)
+		assert.Equal(t, "/tmp", command.Cwd)
+		assert.Equal(t, Args{"--token", "s3cr3t", "${LITERAL}", "$HOME", ""}, command.Args)
+		assert.Equal(t, map[string]string{"TOKEN": "s3cr3t", "LEVEL": "info"}, command.Env)
+		assert.Equal(t, []string{"/opt/app/env"}, command.EnvFile)
+
+		assert.NotContains(t, command.String(), "s3cr3t")
+		assert.Contains(t, command.String(), "/opt/app/bin/deploy")
+		assert.NotContains(t, fmt.Sprintf("%+v", config), "s3cr3t", "Config dumps should mask secrets")
+		assert.Equal(t, []string{"--token", "******", "${LITERAL}", "$HOME", ""}, command.MaskArgs(command.Args))
+		assert.Equal(t, "******", command.Mask("s3cr3t"))
+	}
+}
+
+func TestMapConfigFileInterpolationErrors(t *testing.T) {
+	_, err := MapConfigFile([]byte("remoteCommand:\n- shortname: deploy\n  path: /bin/deploy\n  env:\n    TOKEN: ${FORKLIFT_TEST_UNSET}"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Missing config variable")
+		assert.Contains(t, err.Error(), "variable=FORKLIFT_TEST_UNSET")
+		assert.Contains(t, err.Error(), "at=remoteCommand[0].env.TOKEN")
+		assert.Contains(t, err.Error(), "line=5")
+	}
+	for _, conf := range []string{"path: ${1BAD}", "path: ${file:/nonexistent/secret}", "args: [\"${FORKLIFT_TEST_UNSET}\"]", "cwd: ${}"} {
+		_, err = MapConfigFile([]byte("remoteCommand:\n- shortname: deploy\n  " + conf))
+		assert.Error(t, err, conf)
+	}
+}
+
+func TestMapConfigFileSecretVariables(t *testing.T) {
+	t.Setenv("FORKLIFT_TEST_PASSWORD", "hunter2")
+	t.Setenv("FORKLIFT_TEST_USER", "admin")
+	config, err := MapConfigFile([]byte("remoteCommand:\n- shortname: db\n  path: /bin/db\n  args: [\"--password=${secret:FORKLIFT_TEST_PASSWORD}\", \"--user=${FORKLIFT_TEST_USER}\"]\n  env:\n    DB_PASSWORD: ${secret:FORKLIFT_TEST_PASSWORD}\n    DB_HOST: ${secret:FORKLIFT_TEST_UNSET:-localhost}"))
+	assert.NoError(t, err)
+	if assert.Len(t, config.RemoteConfig, 1) {
+		command := config.RemoteConfig[0]
+		assert.Equal(t, Args{"--password=hunter2", "--user=admin"}, command.Args)
+		assert.Equal(t, map[string]string{"DB_PASSWORD": "hunter2", "DB_HOST": "localhost"}, command.Env)
+		assert.NotContains(t, command.String(), "hunter2")
+		assert.NotContains(t, fmt.Sprintf("%+v", config), "hunter2", "Config dumps should mask secret variables")
+		assert.Contains(t, command.String(), "admin", "Variables not marked secret are kept")
+		assert.Equal(t, []string{"--password=******", "--user=admin"}, command.MaskArgs(command.Args))
+	}
+	_, err = MapConfigFile([]byte("remoteCommand:\n- shortname: db\n  path: /bin/db\n  env:\n    DB_PASSWORD: ${secret:FORKLIFT_TEST_UNSET}"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Missing config variable")
+	}
+}
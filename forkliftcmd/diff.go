@@ -0,0 +1,48 @@
+package forkliftcmd
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Name identifies the command, its shortname or its path without one.
+func (fc ForkliftCommand) Name() string {
+	if fc.Shortname != "" {
+		return fc.Shortname
+	}
+	return fc.Path
+}
+
+// DiffCommands compares commands by Name and returns the sorted names
+// of the ones added, changed or removed in next.
+func DiffCommands(previous []ForkliftCommand, next []ForkliftCommand) (added []string, changed []string, removed []string) {
+	previousByName := make(map[string]ForkliftCommand, len(previous))
+	for _, command := range previous {
+		previousByName[command.Name()] = command
+	}
+	nextByName := make(map[string]bool, len(next))
+	for _, command := range next {
+		nextByName[command.Name()] = true
+		old, ok := previousByName[command.Name()]
+		if !ok {
+			added = append(added, command.Name())
+		} else if !sameCommand(old, command) {
+			changed = append(changed, command.Name())
+		}
+	}
+	for name := range previousByName {
+		if !nextByName[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(changed)
+	sort.Strings(removed)
+	return added, changed, removed
+}
+
+// sameCommand ignores the Source of commands, moving one to another file doesn't change it.
+func sameCommand(a ForkliftCommand, b ForkliftCommand) bool {
+	a.Source, b.Source = "", ""
+	return reflect.DeepEqual(a, b)
+}
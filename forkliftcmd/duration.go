@@ -0,0 +1,85 @@
+package forkliftcmd
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// unmarshalConfig decodes the config object b into v, its time.Duration fields are
+// Go duration strings like "30s" or integers of milliseconds.
+func unmarshalConfig(b []byte, v interface{}) error {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(b, &object); err != nil {
+		// not an object, yaml reports it
+		return yaml.Unmarshal(b, v)
+	}
+	for key, raw := range object {
+		if _, ok := durationField(reflect.TypeOf(v).Elem(), key); !ok {
+			continue
+		}
+		duration, err := parseDuration(raw)
+		if err != nil {
+			return errs.WithEF(err, data.WithField("key", key).WithField("value", string(raw)), "Invalid duration")
+		}
+		object[key] = json.RawMessage(strconv.FormatInt(int64(duration), 10))
+	}
+	b, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(b, v)
+}
+
+// marshalConfig encodes v with its time.Duration fields as Go duration strings, that unmarshalConfig reads back.
+func marshalConfig(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]json.RawMessage
+	if err = json.Unmarshal(b, &object); err != nil {
+		return nil, err
+	}
+	value := reflect.ValueOf(v)
+	for key := range object {
+		if field, ok := durationField(value.Type(), key); ok {
+			object[key], _ = json.Marshal(value.FieldByIndex(field.Index).Interface().(time.Duration).String())
+		}
+	}
+	return json.Marshal(object)
+}
+
+func durationField(t reflect.Type, key string) (reflect.StructField, bool) {
+	field, ok := jsonField(t, key)
+	return field, ok && field.Type == durationType
+}
+
+// parseDuration reads a Go duration string or an integer of milliseconds, in a string or not.
+func parseDuration(raw json.RawMessage) (time.Duration, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return 0, err
+	}
+	switch value := value.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return time.Duration(value * float64(time.Millisecond)), nil
+	case string:
+		value = strings.TrimSpace(value)
+		if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Duration(ms) * time.Millisecond, nil
+		}
+		return time.ParseDuration(value)
+	}
+	return 0, errs.With("Duration must be a string like 30s or an integer of milliseconds")
+}
@@ -0,0 +1,64 @@
+package forkliftcmd
+
+import (
+	"time"
+
+	"github.com/n0rad/go-erlog/errs"
+)
+
+const (
+	DefaultHealthInterval  = 10 * time.Second
+	DefaultHealthTimeout   = time.Second
+	DefaultHealthThreshold = 3
+)
+
+// HealthCheck probes a supervised command with exactly one of Exec, HTTP or TCP.
+// The command is unhealthy after Threshold consecutive failures.
+type HealthCheck struct {
+	// Exec runs a probe command, it succeeds with exit code 0.
+	Exec []string `json:"exec,omitempty" yaml:"exec,omitempty"`
+	// HTTP is an url getting a 2xx or 3xx, like http://localhost:8080/health.
+	HTTP string `json:"http,omitempty" yaml:"http,omitempty"`
+	// TCP is an address accepting connections, like localhost:5432.
+	TCP string `json:"tcp,omitempty" yaml:"tcp,omitempty"`
+	// Interval and Timeout are durations like "10s", or integers of milliseconds.
+	Interval  time.Duration `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Timeout   time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Threshold int           `json:"threshold,omitempty" yaml:"threshold,omitempty"`
+}
+
+type healthCheckConfig HealthCheck
+
+func (h *HealthCheck) UnmarshalJSON(b []byte) (err error) {
+	healthUnmarshal := healthCheckConfig(*h)
+	if err = unmarshalConfig(b, &healthUnmarshal); err != nil {
+		return err
+	}
+	probes := 0
+	for _, set := range []bool{len(healthUnmarshal.Exec) > 0, healthUnmarshal.HTTP != "", healthUnmarshal.TCP != ""} {
+		if set {
+			probes++
+		}
+	}
+	if probes != 1 {
+		return errs.With("Health check needs exactly one of exec, http or tcp")
+	}
+	if healthUnmarshal.Interval < 0 || healthUnmarshal.Timeout < 0 || healthUnmarshal.Threshold < 0 {
+		return errs.With("Health check interval, timeout and threshold can't be negative")
+	}
+	if healthUnmarshal.Interval == 0 {
+		healthUnmarshal.Interval = DefaultHealthInterval
+	}
+	if healthUnmarshal.Timeout == 0 {
+		healthUnmarshal.Timeout = DefaultHealthTimeout
+	}
+	if healthUnmarshal.Threshold == 0 {
+		healthUnmarshal.Threshold = DefaultHealthThreshold
+	}
+	*h = HealthCheck(healthUnmarshal)
+	return nil
+}
+
+func (h HealthCheck) MarshalJSON() ([]byte, error) {
+	return marshalConfig(healthCheckConfig(h))
+}
@@ -0,0 +1,124 @@
+package forkliftcmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+const (
+	filePrefix   = "file:"
+	secretPrefix = "secret:"
+	secretMask   = "******"
+)
+
+// variableReference matches ${...}, $${...} escapes it.
+var variableReference = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// interpolate replaces the ${VAR}, ${VAR:-default}, ${secret:VAR} and ${file:/path} of the path, cwd,
+// args and env of the command. Values of ${secret:VAR} and read from files are secrets, masked by String.
+func (fc *fcConfig) interpolate() (err error) {
+	fc.secrets = nil
+	if fc.Path, err = fc.expand("path", fc.Path); err != nil {
+		return err
+	}
+	if fc.Cwd, err = fc.expand("cwd", fc.Cwd); err != nil {
+		return err
+	}
+	for i, arg := range fc.Args {
+		if fc.Args[i], err = fc.expand("args", arg); err != nil {
+			return err
+		}
+	}
+	for name, value := range fc.Env {
+		if fc.Env[name], err = fc.expand("env."+name, value); err != nil {
+			return err
+		}
+	}
+	for i, file := range fc.EnvFile {
+		if fc.EnvFile[i], err = fc.expand("envFile", file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fc *fcConfig) expand(key string, value string) (string, error) {
+	var err error
+	expanded := variableReference.ReplaceAllStringFunc(value, func(reference string) string {
+		if err != nil {
+			return reference
+		}
+		if strings.HasPrefix(reference, "$$") {
+			return reference[1:]
+		}
+		var resolved string
+		var secret bool
+		if resolved, secret, err = resolve(key, reference[2:len(reference)-1]); err != nil {
+			return reference
+		}
+		if secret && resolved != "" {
+			fc.secrets = append(fc.secrets, resolved)
+		}
+		return resolved
+	})
+	return expanded, err
+}
+
+// resolve returns the value of the expression of a ${...} and if it is a secret.
+func resolve(key string, expression string) (value string, secret bool, err error) {
+	if strings.HasPrefix(expression, filePrefix) {
+		path := strings.TrimPrefix(expression, filePrefix)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", true, errs.WithEF(err, data.WithField("key", key).WithField("file", path), "Failed to read config variable file")
+		}
+		return strings.TrimRight(string(content), "\r\n"), true, nil
+	}
+	if strings.HasPrefix(expression, secretPrefix) {
+		expression, secret = strings.TrimPrefix(expression, secretPrefix), true
+	}
+	name, defaultValue, hasDefault := strings.Cut(expression, ":-")
+	if !variableName.MatchString(name) {
+		return "", secret, errs.WithF(data.WithField("key", key).WithField("variable", expression), "Invalid config variable")
+	}
+	if variable, ok := os.LookupEnv(name); ok && (variable != "" || !hasDefault) {
+		return variable, secret, nil
+	}
+	if !hasDefault {
+		return "", secret, errs.WithF(data.WithField("key", key).WithField("variable", name), "Missing config variable")
+	}
+	return defaultValue, secret, nil
+}
+
+// String masks the secrets interpolated in the command, for the logs dumping the config.
+func (fc ForkliftCommand) String() string {
+	return fc.Mask(fmt.Sprintf("%+v", fcConfig(fc)))
+}
+
+// Mask hides the secrets interpolated in the command from value.
+func (fc ForkliftCommand) Mask(value string) string {
+	for _, secret := range fc.secrets {
+		value = strings.Replace(value, secret, secretMask, -1)
+	}
+	return value
+}
+
+// MaskArgs hides the secrets interpolated in the command from args, to log or show them.
+func (fc ForkliftCommand) MaskArgs(args []string) []string {
+	if len(fc.secrets) == 0 || args == nil {
+		return args
+	}
+	masked := make([]string, len(args))
+	for i, arg := range args {
+		masked[i] = fc.Mask(arg)
+	}
+	return masked
+}
@@ -0,0 +1,34 @@
+package forkliftcmd
+
+import (
+	"strconv"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// Rlimits are applied as both soft and hard limits, 0 keeps forklift's own.
+type Rlimits struct {
+	NoFile uint64 `json:"nofile,omitempty" yaml:"nofile,omitempty"`
+	NProc  uint64 `json:"nproc,omitempty" yaml:"nproc,omitempty"`
+	// CPU is in seconds.
+	CPU uint64 `json:"cpu,omitempty" yaml:"cpu,omitempty"`
+	// AS is the address space in bytes.
+	AS uint64 `json:"as,omitempty" yaml:"as,omitempty"`
+}
+
+func (r Rlimits) IsZero() bool {
+	return r == Rlimits{}
+}
+
+// ParseUmask reads an octal umask like "022", an empty one returns -1.
+func ParseUmask(umask string) (int, error) {
+	if umask == "" {
+		return -1, nil
+	}
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || mask > 0777 {
+		return -1, errs.WithF(data.WithField("umask", umask), "Invalid umask")
+	}
+	return int(mask), nil
+}
@@ -0,0 +1,124 @@
+package forkliftcmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+// configLoader merges config files into one config.
+type configLoader struct {
+	config ForkliftCommandConfig
+	// loaded are the absolute paths of the files read, each one is read once
+	loaded map[string]bool
+	// authSource is the file defining the auth, only one may
+	authSource string
+}
+
+// LoadConfig reads the config file at path, or the *.yml files of the directory at path
+// in lexical order, and the files they include. Every command remembers its Source file,
+// Validate reports the names defined in several files.
+func LoadConfig(path string) (ForkliftCommandConfig, error) {
+	loader := &configLoader{
+		config: ForkliftCommandConfig{lines: map[string][]int{}},
+		loaded: make(map[string]bool),
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return loader.config, errs.WithEF(err, data.WithField("file", path), "Failed to read config")
+	}
+	if info.IsDir() {
+		err = loader.loadGlob(filepath.Join(path, "*.yml"))
+	} else {
+		err = loader.loadFile(path)
+	}
+	return loader.config, err
+}
+
+// Files are the files and directories the config was read from, to watch them for changes.
+func (cfg ForkliftCommandConfig) Files() []string {
+	return cfg.files
+}
+
+func (l *configLoader) loadGlob(pattern string) error {
+	// the directory is watched for added or removed files
+	l.config.files = append(l.config.files, filepath.Dir(pattern))
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("pattern", pattern), "Invalid config include pattern")
+	}
+	for _, file := range files {
+		if err = l.loadFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *configLoader) loadFile(path string) error {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("file", path), "Failed to read config file")
+	}
+	if l.loaded[absolute] {
+		logs.WithField("file", path).Debug("Config file already loaded")
+		return nil
+	}
+	l.loaded[absolute] = true
+	l.config.files = append(l.config.files, path)
+	logs.WithField("file", path).Debug("Loading config file")
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("file", path), "Failed to read config file")
+	}
+	config, err := MapConfigFile(content)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("file", path), "Invalid config file")
+	}
+	if err = l.merge(path, config); err != nil {
+		return err
+	}
+	for _, include := range config.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		if strings.ContainsAny(include, "*?[") {
+			err = l.loadGlob(include)
+		} else {
+			err = l.loadFile(include)
+		}
+		if err != nil {
+			return errs.WithEF(err, data.WithField("file", path).WithField("include", include), "Failed to include config")
+		}
+	}
+	return nil
+}
+
+func (l *configLoader) merge(path string, config ForkliftCommandConfig) error {
+	for i := range config.LocalConfig {
+		config.LocalConfig[i].Source = path
+	}
+	for i := range config.RemoteConfig {
+		config.RemoteConfig[i].Source = path
+	}
+	l.config.LocalConfig = append(l.config.LocalConfig, config.LocalConfig...)
+	l.config.RemoteConfig = append(l.config.RemoteConfig, config.RemoteConfig...)
+	for section, lines := range config.lines {
+		l.config.lines[section] = append(l.config.lines[section], lines...)
+	}
+	if reflect.DeepEqual(config.Auth, Auth{}) {
+		return nil
+	}
+	if l.authSource != "" {
+		return errs.WithF(data.WithField("file", path).WithField("definedIn", l.authSource), "Auth is defined in several config files")
+	}
+	l.authSource = path
+	l.config.Auth = config.Auth
+	return nil
+}
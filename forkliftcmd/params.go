@@ -0,0 +1,208 @@
+package forkliftcmd
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+const (
+	ParamString = "string"
+	ParamInt    = "int"
+	ParamEnum   = "enum"
+	ParamBool   = "bool"
+	ParamPath   = "path"
+)
+
+var paramName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Param declares a typed parameter of a remote command. Requests set params by
+// name and the command args are rendered from ArgsTemplate, raw args are refused.
+// Type defaults to string. Pattern is anchored, without one string and path
+// values can't start with "-". Path values are cleaned and must stay under Root.
+type Param struct {
+	Name        string      `json:"name" yaml:"name"`
+	Type        string      `json:"type,omitempty" yaml:"type,omitempty"`
+	Description string      `json:"description,omitempty" yaml:"description,omitempty"`
+	Pattern     string      `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+	Enum        []string    `json:"enum,omitempty" yaml:"enum,omitempty"`
+	Root        string      `json:"root,omitempty" yaml:"root,omitempty"`
+	Default     interface{} `json:"default,omitempty" yaml:"default,omitempty"`
+	Required    bool        `json:"required,omitempty" yaml:"required,omitempty"`
+}
+
+// Templated tells if the command args are rendered from params instead of taken from requests.
+func (fc ForkliftCommand) Templated() bool {
+	return len(fc.Params) > 0 || len(fc.ArgsTemplate) > 0
+}
+
+func validateParams(fc fcConfig) error {
+	if len(fc.ArgsTemplate) > 0 && len(fc.Args) > 0 {
+		return errs.WithF(data.WithField("command", fc.Shortname), "Args and argsTemplate can't be both set")
+	}
+	if fc.AllowArgs && (len(fc.Params) > 0 || len(fc.ArgsTemplate) > 0) {
+		return errs.WithF(data.WithField("command", fc.Shortname), "AllowArgs can't be set with params or argsTemplate")
+	}
+	names := map[string]bool{}
+	for _, param := range fc.Params {
+		fields := data.WithField("command", fc.Shortname).WithField("param", param.Name)
+		if !paramName.MatchString(param.Name) {
+			return errs.WithF(fields, "Invalid param name")
+		}
+		if names[param.Name] {
+			return errs.WithF(fields, "Duplicate param name")
+		}
+		names[param.Name] = true
+		switch param.Type {
+		case "", ParamString, ParamInt, ParamBool, ParamPath:
+		case ParamEnum:
+			if len(param.Enum) == 0 {
+				return errs.WithF(fields, "Enum param without values")
+			}
+		default:
+			return errs.WithF(fields.WithField("type", param.Type), "Unknown param type")
+		}
+		if _, err := regexp.Compile(param.Pattern); err != nil {
+			return errs.WithEF(err, fields, "Invalid param pattern")
+		}
+		if param.Default != nil {
+			if _, err := param.value(param.defaultValue()); err != nil {
+				return errs.WithEF(err, fields, "Invalid param default")
+			}
+		}
+	}
+	for _, arg := range fc.ArgsTemplate {
+		if _, err := template.New("args").Option("missingkey=error").Parse(arg); err != nil {
+			return errs.WithEF(err, data.WithField("command", fc.Shortname).WithField("arg", arg), "Invalid args template")
+		}
+	}
+	return nil
+}
+
+func (p Param) defaultValue() string {
+	if p.Default == nil {
+		return ""
+	}
+	if f, ok := p.Default.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(p.Default)
+}
+
+// value checks raw against the param constraints and returns it typed for the template.
+func (p Param) value(raw string) (interface{}, error) {
+	fields := data.WithField("param", p.Name).WithField("value", raw)
+	if p.Pattern != "" && !regexp.MustCompile("^(?:"+p.Pattern+")$").MatchString(raw) {
+		return nil, errs.WithF(fields.WithField("pattern", p.Pattern), "Param value does not match pattern")
+	}
+	switch p.Type {
+	case ParamInt:
+		value, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, errs.WithEF(err, fields, "Param value is not an int")
+		}
+		return value, nil
+	case ParamBool:
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, errs.WithEF(err, fields, "Param value is not a bool")
+		}
+		return value, nil
+	case ParamEnum:
+		if !contains(p.Enum, raw, "") {
+			return nil, errs.WithF(fields.WithField("enum", p.Enum), "Param value is not allowed")
+		}
+		return raw, nil
+	case ParamPath:
+		if p.Pattern == "" && strings.HasPrefix(raw, "-") {
+			return nil, errs.WithF(fields, "Param value can't start with -")
+		}
+		if strings.ContainsRune(raw, 0) {
+			return nil, errs.WithF(fields, "Param value is not a path")
+		}
+		path := filepath.Clean(raw)
+		if p.Root != "" {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(p.Root, path)
+			}
+			if rel, err := filepath.Rel(p.Root, path); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+				return nil, errs.WithF(fields.WithField("root", p.Root), "Param path is outside of root")
+			}
+		} else if path == ".." || strings.HasPrefix(path, "../") || strings.Contains(path, "/../") {
+			return nil, errs.WithF(fields, "Param path can't go up")
+		}
+		return path, nil
+	default:
+		if p.Pattern == "" && strings.HasPrefix(raw, "-") {
+			return nil, errs.WithF(fields, "Param value can't start with -")
+		}
+		return raw, nil
+	}
+}
+
+// RenderArgs validates the request params against the command params and renders
+// ArgsTemplate with them. Each template entry is one arg, empty ones are dropped.
+func (fc ForkliftCommand) RenderArgs(params map[string]string) ([]string, error) {
+	declared := map[string]Param{}
+	for _, param := range fc.Params {
+		declared[param.Name] = param
+	}
+	for name := range params {
+		if _, ok := declared[name]; !ok {
+			return nil, errs.WithF(data.WithField("param", name), "Unknown param")
+		}
+	}
+	values := map[string]interface{}{}
+	for _, param := range fc.Params {
+		raw, ok := params[param.Name]
+		if !ok && param.Required {
+			return nil, errs.WithF(data.WithField("param", param.Name), "Missing required param")
+		}
+		if !ok && param.Default == nil {
+			values[param.Name] = zeroValue(param.Type)
+			continue
+		}
+		if !ok {
+			raw = param.defaultValue()
+		}
+		value, err := param.value(raw)
+		if err != nil {
+			return nil, err
+		}
+		values[param.Name] = value
+	}
+
+	args := []string{}
+	for _, arg := range fc.ArgsTemplate {
+		tmpl, err := template.New("args").Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, errs.WithEF(err, data.WithField("arg", arg), "Invalid args template")
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, values); err != nil {
+			return nil, errs.WithEF(err, data.WithField("arg", arg), "Failed to render args template")
+		}
+		if out.Len() > 0 {
+			args = append(args, out.String())
+		}
+	}
+	return args, nil
+}
+
+func zeroValue(paramType string) interface{} {
+	switch paramType {
+	case ParamInt:
+		return 0
+	case ParamBool:
+		return false
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,23 @@
+package forkliftcmd
+
+import (
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
+// ParseRestartPolicy validates a restart policy, an empty one means RestartAlways.
+func ParseRestartPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return RestartAlways, nil
+	case RestartAlways, RestartOnFailure, RestartNever:
+		return policy, nil
+	}
+	return "", errs.WithF(data.WithField("restart", policy), "Unknown restart policy")
+}
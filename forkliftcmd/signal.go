@@ -0,0 +1,58 @@
+package forkliftcmd
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+const DefaultStopSignal = syscall.SIGTERM
+
+var signalNames = map[string]syscall.Signal{
+	"SIGABRT":  syscall.SIGABRT,
+	"SIGALRM":  syscall.SIGALRM,
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGKILL":  syscall.SIGKILL,
+	"SIGPIPE":  syscall.SIGPIPE,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGWINCH": syscall.SIGWINCH,
+	"SIGCONT":  syscall.SIGCONT,
+	"SIGSTOP":  syscall.SIGSTOP,
+	"SIGTSTP":  syscall.SIGTSTP,
+}
+
+// ParseSignal accepts a signal as "SIGTERM", "TERM" or "15".
+// An empty name returns DefaultStopSignal.
+func ParseSignal(name string) (syscall.Signal, error) {
+	if name == "" {
+		return DefaultStopSignal, nil
+	}
+	if num, err := strconv.Atoi(name); err == nil && num > 0 {
+		return syscall.Signal(num), nil
+	}
+	upper := strings.ToUpper(name)
+	if !strings.HasPrefix(upper, "SIG") {
+		upper = "SIG" + upper
+	}
+	if sig, ok := signalNames[upper]; ok {
+		return sig, nil
+	}
+	return 0, errs.WithF(data.WithField("signal", name), "Unknown signal")
+}
+
+// SignalName returns the "SIGTERM" form of sig, or its number when unknown.
+func SignalName(sig syscall.Signal) string {
+	for name, known := range signalNames {
+		if known == sig {
+			return name
+		}
+	}
+	return strconv.Itoa(int(sig))
+}
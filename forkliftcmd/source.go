@@ -0,0 +1,260 @@
+package forkliftcmd
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// typeErrorField extracts the field path of the json type errors, that ghodss/yaml turns into strings.
+var typeErrorField = regexp.MustCompile(`Go struct field \w+\.([\w.]+) of type`)
+
+// configSource finds the lines of the keys of a yaml config file, for error messages.
+// Only the block style is followed, keys in flow style get the line of their parent.
+type configSource struct {
+	lines []sourceLine
+}
+
+type sourceLine struct {
+	number int
+	// indent is the column of the content, after the "- " of a sequence item
+	indent int
+	// dash is the column of the "- " of a sequence item, -1 for other lines
+	dash int
+	text string
+}
+
+func newConfigSource(content []byte) *configSource {
+	source := &configSource{}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(line, "\r")
+		text := strings.TrimLeft(line, " ")
+		if text == "" || text[0] == '#' || text == "---" {
+			continue
+		}
+		l := sourceLine{number: i + 1, indent: len(line) - len(text), dash: -1}
+		if text == "-" || strings.HasPrefix(text, "- ") {
+			l.dash = l.indent
+			rest := strings.TrimLeft(text[1:], " ")
+			l.indent += len(text) - len(rest)
+			text = rest
+		}
+		l.text = text
+		source.lines = append(source.lines, l)
+	}
+	return source
+}
+
+// Line returns the line of the value at path, made of keys and sequence indexes.
+// It is the line of the deepest element found, 0 when none is.
+func (s *configSource) Line(path ...interface{}) int {
+	if s == nil {
+		return 0
+	}
+	start, end, line := 0, len(s.lines), 0
+	for _, elem := range path {
+		i := -1
+		switch elem := elem.(type) {
+		case string:
+			if i = s.findKey(start, end, elem); i >= 0 {
+				start, end = i+1, s.valueEnd(i, end)
+			}
+		case int:
+			if i = s.findItem(start, end, elem); i >= 0 {
+				start, end = i, s.itemEnd(i, end)
+			}
+		}
+		if i < 0 {
+			return line
+		}
+		line = s.lines[i].number
+	}
+	return line
+}
+
+func (s *configSource) findKey(start int, end int, key string) int {
+	base := -1
+	for i := start; i < end; i++ {
+		l := s.lines[i]
+		if l.text == "" {
+			continue
+		}
+		if base < 0 {
+			base = l.indent
+		}
+		if l.indent != base {
+			continue
+		}
+		for _, prefix := range []string{key, `"` + key + `"`, `'` + key + `'`} {
+			if strings.HasPrefix(l.text, prefix+":") {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// valueEnd is the end of the lines of the value of the key at i, a sequence may start at the key's column.
+func (s *configSource) valueEnd(i int, end int) int {
+	column := s.lines[i].indent
+	for j := i + 1; j < end; j++ {
+		l := s.lines[j]
+		if !(l.dash < 0 && l.indent > column || l.dash >= column) {
+			return j
+		}
+	}
+	return end
+}
+
+func (s *configSource) findItem(start int, end int, index int) int {
+	column := -1
+	for i := start; i < end; i++ {
+		l := s.lines[i]
+		if column < 0 {
+			column = l.dash
+			if column < 0 {
+				return -1
+			}
+		}
+		if l.dash != column {
+			continue
+		}
+		if index == 0 {
+			return i
+		}
+		index--
+	}
+	return -1
+}
+
+func (s *configSource) itemEnd(i int, end int) int {
+	column := s.lines[i].dash
+	for j := i + 1; j < end; j++ {
+		l := s.lines[j]
+		if !(l.dash < 0 && l.indent > column || l.dash > column) {
+			return j
+		}
+	}
+	return end
+}
+
+// checkKeys reports the keys of document matching no field of t, that json would silently ignore.
+func (s *configSource) checkKeys(document interface{}, t reflect.Type, path []interface{}) (problems configProblems) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch document := document.(type) {
+	case map[string]interface{}:
+		for key, value := range document {
+			keyPath := append(path[:len(path):len(path)], key)
+			switch t.Kind() {
+			case reflect.Struct:
+				field, ok := jsonField(t, key)
+				if !ok {
+					problems = append(problems, errs.WithF(data.WithField("key", formatPath(keyPath)).
+						WithField("line", s.Line(keyPath...)), "Unknown config key"))
+					continue
+				}
+				problems = append(problems, s.checkKeys(value, field.Type, keyPath)...)
+			case reflect.Map:
+				problems = append(problems, s.checkKeys(value, t.Elem(), keyPath)...)
+			}
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return nil
+		}
+		for i, value := range document {
+			problems = append(problems, s.checkKeys(value, t.Elem(), append(path[:len(path):len(path)], i))...)
+		}
+	}
+	return problems
+}
+
+// jsonField finds the field json decodes key into, ignoring case like json does.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// errorAt locates a decoding error of the value at path, down to the key
+// of the error or the field of json type errors.
+func (s *configSource) errorAt(err error, path ...interface{}) error {
+	var keys string
+	if entry, ok := err.(*errs.EntryError); ok {
+		keys, _ = entry.Fields["key"].(string)
+	}
+	if match := typeErrorField.FindStringSubmatch(err.Error()); keys == "" && match != nil {
+		keys = match[1]
+	}
+	if keys != "" {
+		for _, key := range strings.Split(keys, ".") {
+			path = append(path, key)
+		}
+	}
+	return errs.WithEF(err, data.WithField("at", formatPath(path)).WithField("line", s.Line(path...)), "Invalid config")
+}
+
+// formatPath renders a path like remoteCommand[0].healthCheck.
+func formatPath(path []interface{}) string {
+	var formatted string
+	for _, elem := range path {
+		switch elem := elem.(type) {
+		case int:
+			formatted += "[" + strconv.Itoa(elem) + "]"
+		default:
+			if formatted != "" {
+				formatted += "."
+			}
+			formatted += elem.(string)
+		}
+	}
+	return formatted
+}
+
+// configProblems are reported all at once, in the order of their files and lines.
+type configProblems []*errs.EntryError
+
+func (p configProblems) err(message string) error {
+	if len(p) == 0 {
+		return nil
+	}
+	sort.SliceStable(p, func(i, j int) bool {
+		fileI, _ := p[i].Fields["file"].(string)
+		fileJ, _ := p[j].Fields["file"].(string)
+		if fileI != fileJ {
+			return fileI < fileJ
+		}
+		return problemLine(p[i]) < problemLine(p[j])
+	})
+	problems := make([]error, len(p))
+	for i, problem := range p {
+		problems[i] = problem
+	}
+	return errs.WithF(data.WithField("problems", len(p)), message).WithErrs(problems...)
+}
+
+func problemLine(problem *errs.EntryError) int {
+	line, _ := problem.Fields["line"].(int)
+	return line
+}
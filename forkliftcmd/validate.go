@@ -0,0 +1,129 @@
+package forkliftcmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// configSection is a list of commands of the config file.
+type configSection struct {
+	key      string
+	commands []ForkliftCommand
+	remote   bool
+}
+
+func (cfg ForkliftCommandConfig) sections() []configSection {
+	return []configSection{
+		{key: "command", commands: cfg.LocalConfig},
+		{key: "remoteCommand", commands: cfg.RemoteConfig, remote: true},
+	}
+}
+
+// Validate checks what decoding can't: unique names, runnable paths, existing cwds and sane durations.
+// Every problem is reported, with its line when the config was read by MapConfigFile
+// and its file when read by LoadConfig.
+func (cfg ForkliftCommandConfig) Validate() error {
+	var problems configProblems
+	for _, section := range cfg.sections() {
+		// definedAt locates the first definition of each name
+		definedAt := make(map[string]string, len(section.commands))
+		for i, command := range section.commands {
+			line := cfg.line(section.key, i)
+			for _, problem := range command.validate(section.remote) {
+				problems = append(problems, command.problem(problem, line))
+			}
+			if first, ok := definedAt[command.Name()]; ok {
+				problems = append(problems, command.problem(errs.WithF(data.WithField("definedAt", first),
+					"Duplicate command name"), line))
+				continue
+			}
+			definedAt[command.Name()] = command.Source + ":" + strconv.Itoa(line)
+		}
+	}
+	return problems.err("Invalid config")
+}
+
+func (cfg ForkliftCommandConfig) line(section string, i int) int {
+	if i < len(cfg.lines[section]) {
+		return cfg.lines[section][i]
+	}
+	return 0
+}
+
+// problem locates a problem of the command.
+func (fc ForkliftCommand) problem(problem *errs.EntryError, line int) *errs.EntryError {
+	problem = problem.WithField("command", fc.Name()).WithField("line", line)
+	if fc.Source != "" {
+		problem = problem.WithField("file", fc.Source)
+	}
+	return problem
+}
+
+func (fc ForkliftCommand) validate(remote bool) (problems []*errs.EntryError) {
+	if remote && fc.Shortname == "" {
+		problems = append(problems, errs.With("Remote command needs a shortname"))
+	}
+	if fc.Path == "" {
+		problems = append(problems, errs.With("Command needs a path"))
+	} else if err := checkExecutable(fc.Path, fc.Cwd); err != nil {
+		problems = append(problems, errs.WithEF(err, data.WithField("path", fc.Path), "Command path is not executable"))
+	}
+	if fc.Cwd != "" {
+		if info, err := os.Stat(fc.Cwd); err != nil || !info.IsDir() {
+			problems = append(problems, errs.WithF(data.WithField("cwd", fc.Cwd), "Command cwd is not a directory"))
+		}
+	}
+	durations := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"timeout", fc.Timeout},
+		{"stopGracePeriod", fc.StopGracePeriod},
+		{"restartWindow", fc.RestartWindow},
+		{"backoff", fc.Backoff},
+		{"maxBackoff", fc.MaxBackoff},
+	}
+	for _, duration := range durations {
+		if duration.value < 0 {
+			problems = append(problems, errs.WithF(data.WithField("key", duration.key), "Duration can't be negative"))
+		}
+	}
+	if fc.MaxBackoff > 0 && fc.Backoff > fc.MaxBackoff {
+		problems = append(problems, errs.WithF(data.WithField("backoff", fc.Backoff).
+			WithField("maxBackoff", fc.MaxBackoff), "Backoff is above maxBackoff"))
+	}
+	if fc.MaxRetries != nil && *fc.MaxRetries < -1 {
+		problems = append(problems, errs.WithF(data.WithField("maxRetries", *fc.MaxRetries), "MaxRetries can't be below -1"))
+	}
+	if fc.HealthCheck != nil && fc.HealthCheck.Timeout > fc.HealthCheck.Interval {
+		problems = append(problems, errs.WithF(data.WithField("timeout", fc.HealthCheck.Timeout).
+			WithField("interval", fc.HealthCheck.Interval), "Health check timeout is above its interval"))
+	}
+	return problems
+}
+
+// checkExecutable finds path like the runner does: in PATH without a slash, from cwd when relative.
+func checkExecutable(path string, cwd string) error {
+	if !strings.Contains(path, "/") {
+		_, err := exec.LookPath(path)
+		return err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cwd, path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return errs.With("Not an executable file")
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/nyodas/forklift/auth"
+	"github.com/nyodas/forklift/forkliftcmd"
+	"github.com/nyodas/forklift/msg"
+	"github.com/nyodas/forklift/runner"
+)
+
+// APIPrefix is where the REST API is mounted.
+const APIPrefix = "/api/"
+
+type apiCommand struct {
+	Shortname string
+	Path      string
+	Args      []string
+	TTY       bool
+	AllowArgs bool                `json:",omitempty"`
+	Params    []forkliftcmd.Param `json:",omitempty"`
+}
+
+type apiJobRequest struct {
+	Command string
+	Args    []string
+	Env     map[string]string
+	Params  map[string]string
+}
+
+type apiError struct {
+	Error   string
+	Code    string `json:",omitempty"`
+	Action  string `json:",omitempty"`
+	Command string `json:",omitempty"`
+}
+
+// outputMessage holds the fields of every job output message.
+type outputMessage struct {
+	msg.Message
+	Prefix string
+	Data   []byte
+}
+
+// API serves the REST endpoints:
+//
+//	GET  /api/commands             configured remote commands
+//	GET  /api/jobs                 jobs
+//	POST /api/jobs                 start a job from {"Command", "Args", "Env", "Params"}
+//	GET  /api/jobs/<id>            job status
+//	GET  /api/jobs/<id>/logs       job output, ?offset=N&follow=true, SSE with Accept: text/event-stream
+//	POST /api/jobs/<id>/kill       stop a job
+//
+// POST requests need a JSON Content-Type and an allowed Origin, so other sites can't forge them.
+func (h *Handler) API(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix), "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "commands":
+		h.apiMethod(w, r, http.MethodGet, h.listCommands)
+	case len(path) == 1 && path[0] == "jobs" && r.Method == http.MethodPost:
+		h.startJob(w, r)
+	case len(path) == 1 && path[0] == "jobs":
+		h.apiMethod(w, r, http.MethodGet, h.listJobs)
+	case len(path) >= 2 && path[0] == "jobs":
+		job := h.Jobs.Get(path[1])
+		if job == nil {
+			writeJSON(w, http.StatusNotFound, apiError{Error: "Unknown job: " + path[1], Code: msg.ErrorNotFound})
+			return
+		}
+		action := forkliftcmd.ActionAttach
+		if len(path) == 3 && path[2] == "kill" {
+			action = forkliftcmd.ActionKill
+		}
+		if !auth.Authorize(requestIdentity(r), job.Config, action) {
+			writeForbidden(w, action, job.Command)
+			return
+		}
+		switch {
+		case len(path) == 2:
+			h.apiMethod(w, r, http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, job.Info())
+			})
+		case len(path) == 3 && path[2] == "logs":
+			h.apiMethod(w, r, http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+				jobLogs(w, r, job)
+			})
+		case len(path) == 3 && path[2] == "kill":
+			h.apiMethod(w, r, http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+				if !h.checkChange(w, r) {
+					return
+				}
+				logs.WithField("job", job.ID).
+					WithField("command", job.Command).
+					WithField("from", r.RemoteAddr).
+					Info("Killing command")
+				go job.Runner.StopBy(runner.KilledByClient)
+				writeJSON(w, http.StatusAccepted, job.Info())
+			})
+		default:
+			writeJSON(w, http.StatusNotFound, apiError{Error: "Not found"})
+		}
+	default:
+		writeJSON(w, http.StatusNotFound, apiError{Error: "Not found"})
+	}
+}
+
+func (h *Handler) apiMethod(w http.ResponseWriter, r *http.Request, method string, handle http.HandlerFunc) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "Method not allowed"})
+		return
+	}
+	handle(w, r)
+}
+
+// checkChange rejects the state-changing requests a browser sends cross-site
+// without a preflight: from another origin or with a form Content-Type.
+func (h *Handler) checkChange(w http.ResponseWriter, r *http.Request) bool {
+	if !h.authenticator().CheckOrigin(r) {
+		writeJSON(w, http.StatusForbidden, apiError{Error: "Origin not allowed", Code: msg.ErrorForbidden})
+		return false
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeJSON(w, http.StatusUnsupportedMediaType, apiError{Error: "Content-Type must be application/json"})
+		return false
+	}
+	return true
+}
+
+func (h *Handler) listCommands(w http.ResponseWriter, r *http.Request) {
+	identity := requestIdentity(r)
+	commands := []apiCommand{}
+	for _, command := range h.config().RemoteConfig {
+		if !command.Allows(identity.Name, identity.Groups, forkliftcmd.ActionExec) {
+			continue
+		}
+		commands = append(commands, apiCommand{
+			Shortname: command.Shortname,
+			Path:      command.Mask(command.Path),
+			Args:      command.MaskArgs(command.Args),
+			TTY:       command.TTY,
+			AllowArgs: command.AllowArgs,
+			Params:    command.Params,
+		})
+	}
+	writeJSON(w, http.StatusOK, commands)
+}
+
+func (h *Handler) listJobs(w http.ResponseWriter, r *http.Request) {
+	identity := requestIdentity(r)
+	jobs := []msg.JobInfo{}
+	for _, job := range h.Jobs.List() {
+		if job.Config.Allows(identity.Name, identity.Groups, forkliftcmd.ActionAttach) {
+			jobs = append(jobs, job.Info())
+		}
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (h *Handler) startJob(w http.ResponseWriter, r *http.Request) {
+	if !h.checkChange(w, r) {
+		return
+	}
+	request := apiJobRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "Invalid job request: " + err.Error()})
+		return
+	}
+	configLocalCmd, found := h.config().FindRemoteCommand(request.Command)
+	if !found {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "Unknown command: " + request.Command, Code: msg.ErrorNotFound})
+		return
+	}
+	if !auth.Authorize(requestIdentity(r), configLocalCmd, forkliftcmd.ActionExec) {
+		writeForbidden(w, forkliftcmd.ActionExec, configLocalCmd.Shortname)
+		return
+	}
+	args, err := commandArgs(configLocalCmd, request.Args, request.Params)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{
+			Error:   strings.TrimSpace(err.Error()),
+			Code:    msg.ErrorInvalidParams,
+			Action:  forkliftcmd.ActionExec,
+			Command: configLocalCmd.Shortname,
+		})
+		return
+	}
+	job := h.Jobs.Start(configLocalCmd, msg.CommandRequest{
+		Message: msg.Message{Type: "exec", Content: request.Command},
+		Args:    args,
+		Env:     request.Env,
+	})
+	w.Header().Set("Location", APIPrefix+"jobs/"+job.ID)
+	writeJSON(w, http.StatusCreated, job.Info())
+}
+
+// jobLogs writes the job output as plain text, or as server-sent events
+// carrying the output messages with their offset as event id.
+func jobLogs(w http.ResponseWriter, r *http.Request, job *Job) {
+	query := r.URL.Query()
+	follow, _ := strconv.ParseBool(query.Get("follow"))
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	offset, err := strconv.ParseInt(query.Get("offset"), 10, 64)
+	if query.Get("offset") == "" {
+		offset, err = 0, nil
+		if lastID := r.Header.Get("Last-Event-ID"); sse && lastID != "" {
+			if offset, err = strconv.ParseInt(lastID, 10, 64); err == nil {
+				offset++
+			}
+		}
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "Invalid offset"})
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	var out bytes.Buffer
+	send := func(offset int64, content []byte) error {
+		if sse {
+			output := outputMessage{}
+			_ = json.Unmarshal(content, &output)
+			fmt.Fprintf(&out, "id: %d\nevent: %s\ndata: %s\n\n", offset, output.Type, content)
+		} else {
+			writeText(&out, content)
+		}
+		if !follow {
+			return nil
+		}
+		_, err := w.Write(out.Bytes())
+		out.Reset()
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	}
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	if follow {
+		w.WriteHeader(http.StatusOK)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	next, _, err := job.each(offset, follow, r.Context().Done(), nil, send)
+	if err != nil {
+		logs.WithE(err).WithField("job", job.ID).Debug("Failed to send job logs")
+		return
+	}
+	if !follow {
+		w.Header().Set("X-Forklift-Offset", strconv.FormatInt(next, 10))
+		w.Write(out.Bytes())
+	}
+}
+
+func writeText(out *bytes.Buffer, content []byte) {
+	output := outputMessage{}
+	if err := json.Unmarshal(content, &output); err != nil {
+		return
+	}
+	switch output.Type {
+	case "log":
+		out.WriteString(output.Content)
+	case "tty":
+		out.Write(output.Data)
+	}
+}
+
+func writeForbidden(w http.ResponseWriter, action string, command string) {
+	writeJSON(w, http.StatusForbidden, apiError{
+		Error:   "Not allowed to " + action + " " + command,
+		Code:    msg.ErrorForbidden,
+		Action:  action,
+		Command: command,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logs.WithE(err).Debug("Failed to write api response")
+	}
+}
@@ -0,0 +1,225 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyodas/forklift/forkliftcmd"
+	"github.com/nyodas/forklift/msg"
+	"github.com/stretchr/testify/assert"
+)
+
+func apiServer(t *testing.T) (*Handler, string) {
+	handler := &Handler{
+		ForkliftConfig: &forkliftcmd.ForkliftCommandConfig{
+			RemoteConfig: []forkliftcmd.ForkliftCommand{
+				{Shortname: "sh", Path: "/bin/sh", Args: forkliftcmd.Args{"-c", "echo hello"}, Cwd: "/", AllowArgs: true},
+			},
+		},
+		Jobs: NewJobRegistry(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler.API))
+	t.Cleanup(server.Close)
+	return handler, server.URL + APIPrefix
+}
+
+func startAPIJob(t *testing.T, url string, body string) msg.JobInfo {
+	resp, err := http.Post(url+"jobs", "application/json", strings.NewReader(body))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	info := msg.JobInfo{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	assert.Equal(t, "/api/jobs/"+info.ID, resp.Header.Get("Location"))
+	return info
+}
+
+func TestAPIListCommands(t *testing.T) {
+	_, url := apiServer(t)
+	resp, err := http.Get(url + "commands")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	commands := []apiCommand{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&commands))
+	assert.Equal(t, []apiCommand{{Shortname: "sh", Path: "/bin/sh", Args: []string{"-c", "echo hello"}, AllowArgs: true}}, commands)
+
+	resp, err = http.Post(url+"commands", "application/json", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestAPIJobLogs(t *testing.T) {
+	handler, url := apiServer(t)
+	info := startAPIJob(t, url, `{"Command": "sh"}`)
+	<-handler.Jobs.Get(info.ID).Done()
+
+	resp, err := http.Get(url + "jobs/" + info.ID + "/logs")
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "hello\n", string(body), "Configured args should be used by default")
+	assert.Equal(t, "2", resp.Header.Get("X-Forklift-Offset"))
+
+	resp, err = http.Get(url + "jobs/" + info.ID)
+	assert.NoError(t, err)
+	status := msg.JobInfo{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	resp.Body.Close()
+	assert.False(t, status.Running)
+	if assert.NotNil(t, status.Exit) {
+		assert.Equal(t, 0, status.Exit.Code)
+	}
+}
+
+func TestAPIFollowLogs(t *testing.T) {
+	_, url := apiServer(t)
+	info := startAPIJob(t, url, `{"Command": "sh", "Args": ["-c", "echo one; sleep 0.2; echo two; exit 2"]}`)
+
+	resp, err := http.Get(url + "jobs/" + info.ID + "/logs?follow=true")
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "one\ntwo\n", string(body), "Following should stream until the job ends")
+
+	req, _ := http.NewRequest(http.MethodGet, url+"jobs/"+info.ID+"/logs?follow=true", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "id: ") || strings.HasPrefix(scanner.Text(), "event: ") {
+			events = append(events, scanner.Text())
+		}
+	}
+	assert.Equal(t, []string{"id: 1", "event: log", "id: 2", "event: exit"}, events, "SSE should resume after Last-Event-ID")
+}
+
+func TestAPIKillJob(t *testing.T) {
+	handler, url := apiServer(t)
+	info := startAPIJob(t, url, `{"Command": "sh", "Args": ["-c", "sleep 30"]}`)
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Post(url+"jobs/"+info.ID+"/kill", "application/json", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	job := handler.Jobs.Get(info.ID)
+	select {
+	case <-job.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Killed job should end")
+	}
+	assert.Equal(t, "client", job.Info().Exit.KilledBy)
+}
+
+func TestAPIRejectsCrossSiteRequests(t *testing.T) {
+	handler, url := apiServer(t)
+	info := startAPIJob(t, url, `{"Command": "sh", "Args": ["-c", "sleep 30"]}`)
+	defer handler.Jobs.Get(info.ID).Runner.Stop()
+
+	for _, test := range []struct {
+		path        string
+		contentType string
+		origin      string
+		status      int
+	}{
+		{"jobs", "text/plain", "", http.StatusUnsupportedMediaType},
+		{"jobs", "application/x-www-form-urlencoded", "", http.StatusUnsupportedMediaType},
+		{"jobs", "application/json", "http://evil.example.com", http.StatusForbidden},
+		{"jobs/" + info.ID + "/kill", "", "", http.StatusUnsupportedMediaType},
+		{"jobs/" + info.ID + "/kill", "application/json", "http://evil.example.com", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, url+test.path, strings.NewReader(`{"Command": "sh"}`))
+		req.Header.Set("Content-Type", test.contentType)
+		req.Header.Set("Origin", test.origin)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, test.status, resp.StatusCode, test.path+" "+test.contentType+" "+test.origin)
+	}
+	assert.Len(t, handler.Jobs.List(), 1, "Rejected requests should not start jobs")
+	assert.True(t, handler.Jobs.Get(info.ID).Info().Running, "Rejected requests should not kill jobs")
+
+	resp, err := http.Post(url+"jobs", "application/json; charset=utf-8", strings.NewReader(`{"Command": "sh"}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "Content-Type parameters should be accepted")
+}
+
+func TestAPIRejectsArgs(t *testing.T) {
+	handler, url := apiServer(t)
+	handler.ForkliftConfig.RemoteConfig[0].AllowArgs = false
+
+	resp, err := http.Post(url+"jobs", "application/json", strings.NewReader(`{"Command": "sh", "Args": ["-c", "touch /tmp/pwned"]}`))
+	assert.NoError(t, err)
+	apiErr := apiError{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&apiErr))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, msg.ErrorInvalidParams, apiErr.Code)
+	assert.Empty(t, handler.Jobs.List(), "Commands without allowArgs should refuse client args")
+
+	info := startAPIJob(t, url, `{"Command": "sh"}`)
+	assert.Equal(t, []string{"-c", "echo hello"}, info.Args, "The configured args should be used")
+}
+
+func TestAPINotFound(t *testing.T) {
+	handler, url := apiServer(t)
+	handler.ForkliftConfig.SetDefaultCommand("/bin/sh", "/")
+	for _, path := range []string{"jobs/nope", "jobs/nope/logs", "nope"} {
+		resp, err := http.Get(url + path)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+	resp, err := http.Post(url+"jobs", "application/json", strings.NewReader(`{"Command": "nope"}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Unknown commands should be rejected, not run as the default command")
+}
+
+func TestAPIJobParams(t *testing.T) {
+	handler, url := apiServer(t)
+	handler.ForkliftConfig.RemoteConfig[0].Args = nil
+	handler.ForkliftConfig.RemoteConfig[0].Params = []forkliftcmd.Param{{Name: "word", Type: forkliftcmd.ParamEnum, Enum: []string{"hello", "bye"}, Default: "bye"}}
+	handler.ForkliftConfig.RemoteConfig[0].ArgsTemplate = []string{"-c", "echo {{.word}}"}
+
+	info := startAPIJob(t, url, `{"Command": "sh"}`)
+	<-handler.Jobs.Get(info.ID).Done()
+	assert.Equal(t, []string{"-c", "echo bye"}, info.Args, "Defaults should be used")
+
+	resp, err := http.Post(url+"jobs", "application/json", strings.NewReader(`{"Command": "sh", "Params": {"word": "ciao"}}`))
+	assert.NoError(t, err)
+	apiErr := apiError{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&apiErr))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, msg.ErrorInvalidParams, apiErr.Code)
+}
+
+func TestAPIUnknownCommand(t *testing.T) {
+	handler, url := apiServer(t)
+	handler.ForkliftConfig.SetDefaultCommand("/bin/sh", "/")
+	handler.ForkliftConfig.RemoteConfig[0].Params = []forkliftcmd.Param{{Name: "code", Type: forkliftcmd.ParamInt}}
+	handler.ForkliftConfig.RemoteConfig[0].ArgsTemplate = []string{"-c", "exit {{.code}}"}
+
+	resp, err := http.Post(url+"jobs", "application/json", strings.NewReader(`{"Command": "nope", "Args": ["-c", "touch /tmp/pwned"]}`))
+	assert.NoError(t, err)
+	apiErr := apiError{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&apiErr))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, msg.ErrorNotFound, apiErr.Code)
+	assert.Empty(t, handler.Jobs.List(), "Raw args of unknown commands should never reach the default command")
+}
@@ -0,0 +1,32 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/nyodas/forklift/auth"
+)
+
+// Authenticated rejects the requests failing authentication and passes
+// the caller identity to next in the request context.
+func (h *Handler) Authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, err := h.authenticator().Authenticate(r)
+		if err != nil {
+			logs.WithE(err).WithField("from", r.RemoteAddr).
+				WithField("path", r.URL.Path).
+				Warn("Authentication failed")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="forklift"`)
+			writeJSON(w, http.StatusUnauthorized, apiError{Error: "Unauthorized"})
+			return
+		}
+		if identity.Method != auth.MethodNone {
+			logs.WithField("identity", identity.Name).
+				WithField("method", identity.Method).
+				WithField("from", r.RemoteAddr).
+				WithField("path", r.URL.Path).
+				Debug("Authenticated")
+		}
+		next(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+	}
+}
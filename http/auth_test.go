@@ -0,0 +1,104 @@
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/nyodas/forklift/auth"
+	"github.com/nyodas/forklift/forkliftcmd"
+	"github.com/nyodas/forklift/msg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticated(t *testing.T) {
+	handler, _ := testServer(t)
+	dir := t.TempDir()
+	tokens := dir + "/tokens"
+	assert.NoError(t, ioutil.WriteFile(tokens, []byte("ci s3cr3t\n"), 0600))
+	authenticator, err := auth.NewAuthenticator(forkliftcmd.Auth{TokensFile: tokens})
+	assert.NoError(t, err)
+	handler.Auth = authenticator
+	server := httptest.NewServer(handler.Authenticated(handler.ExecRemoteCmd))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	header := http.Header{"Authorization": []string{"Bearer s3cr3t"}, "Origin": []string{"https://evil.example.com"}}
+	_, resp, err = websocket.DefaultDialer.Dial(url, header)
+	assert.Error(t, err, "Foreign origins should be rejected")
+
+	header.Del("Origin")
+	c, _, err := websocket.DefaultDialer.Dial(url, header)
+	if assert.NoError(t, err) {
+		c.Close()
+	}
+}
+
+func TestAuthorizeACL(t *testing.T) {
+	handler, _ := testServer(t)
+	handler.ForkliftConfig.RemoteConfig[0].ACL = []forkliftcmd.ACLRule{
+		{Identities: []string{"ci"}, Actions: []string{forkliftcmd.ActionExec}},
+	}
+	tokens := t.TempDir() + "/tokens"
+	assert.NoError(t, ioutil.WriteFile(tokens, []byte("ci s3cr3t\ndev d3v\n"), 0600))
+	authenticator, err := auth.NewAuthenticator(forkliftcmd.Auth{TokensFile: tokens})
+	assert.NoError(t, err)
+	handler.Auth = authenticator
+	server := httptest.NewServer(handler.Authenticated(handler.ExecRemoteCmd))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	request := msg.CommandRequest{Message: msg.Message{Type: "exec", Content: "sh"}, Args: []string{"-c", "true"}}
+
+	exec := func(token string) msg.Error {
+		c, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": []string{"Bearer " + token}})
+		if !assert.NoError(t, err) {
+			return msg.Error{}
+		}
+		defer c.Close()
+		assert.NoError(t, request.Send(c))
+		reply := msg.Error{}
+		assert.NoError(t, c.ReadJSON(&reply))
+		return reply
+	}
+	assert.Equal(t, "attached", exec("s3cr3t").Type)
+	denied := exec("d3v")
+	assert.Equal(t, "error", denied.Type)
+	assert.Equal(t, msg.ErrorForbidden, denied.Code)
+	assert.Equal(t, forkliftcmd.ActionExec, denied.Action)
+	assert.Equal(t, "sh", denied.Command)
+	request.Type = "args"
+	denied = exec("s3cr3t")
+	assert.Equal(t, msg.ErrorForbidden, denied.Code, "Args should be authorized against the remote command ACL")
+	assert.Equal(t, forkliftcmd.ActionArgs, denied.Action)
+	request.Type = "exec"
+
+	apiServer := httptest.NewServer(handler.Authenticated(handler.API))
+	defer apiServer.Close()
+	req, _ := http.NewRequest(http.MethodPost, apiServer.URL+APIPrefix+"jobs", strings.NewReader(`{"Command": "sh"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer d3v")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	jobs := handler.Jobs.List()
+	if assert.Len(t, jobs, 1) {
+		<-jobs[0].Done()
+		req, _ = http.NewRequest(http.MethodGet, apiServer.URL+APIPrefix+"jobs/"+jobs[0].ID, nil)
+		req.Header.Set("Authorization", "Bearer s3cr3t")
+		resp, err = http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Attach is not granted by exec")
+	}
+}
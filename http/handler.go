@@ -1,38 +1,122 @@
 package http
 
 import (
+	"crypto/x509"
+	"encoding/json"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
 	"github.com/n0rad/go-erlog/logs"
+	"github.com/nyodas/forklift/auth"
 	"github.com/nyodas/forklift/forkliftcmd"
-	"github.com/nyodas/forklift/logstreamer"
 	"github.com/nyodas/forklift/msg"
 	"github.com/nyodas/forklift/runner"
+	"github.com/nyodas/forklift/supervisor"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
 type Handler struct {
 	ForkliftConfig *forkliftcmd.ForkliftCommandConfig
+	Jobs           *JobRegistry
+	Auth           *auth.Authenticator
+	Metrics        *Metrics
+	Supervisor     *supervisor.Supervisor
+
+	// mu guards ForkliftConfig and Auth once serving, they are swapped by Reload
+	mu sync.RWMutex
+}
+
+// Reload swaps the config and the authenticator, running jobs keep the config they started with.
+func (h *Handler) Reload(config *forkliftcmd.ForkliftCommandConfig, authenticator *auth.Authenticator) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ForkliftConfig = config
+	h.Auth = authenticator
+}
+
+func (h *Handler) config() *forkliftcmd.ForkliftCommandConfig {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.ForkliftConfig
+}
+
+func (h *Handler) authenticator() *auth.Authenticator {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.Auth
+}
+
+// ClientCAs is the pool of the current authenticator client certificates are verified against.
+func (h *Handler) ClientCAs() *x509.CertPool {
+	return h.authenticator().ClientCAs()
+}
+
+func (h *Handler) upgrader() websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     h.authenticator().CheckOrigin,
+	}
 }
 
 func (h *Handler) ExecRemoteCmd(w http.ResponseWriter, r *http.Request) {
-	var forkliftExec *runner.Runner
+	var job *Job
+	var stop chan struct{}
+	var streaming sync.WaitGroup
+	// writeMu serializes the output stream and the stdin credits
+	var writeMu sync.Mutex
+	// window holds a slot per stdin message not yet written to the command, credits the freed ones
+	var window, credits chan struct{}
+	upgrader := h.upgrader()
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		logs.WithE(err).WithField("from", r.RemoteAddr).
 			Error("Error with the websocket upgrade")
 		return
 	}
+	defer h.Metrics.Connected()()
 
+	// a goroutine streams the job output and another the stdin credits, replies wait for them to stop
+	attach := func(attached *Job, offset int64) {
+		job = attached
+		stop = make(chan struct{})
+		window = make(chan struct{}, msg.StdinWindow)
+		credits = make(chan struct{}, msg.StdinWindow)
+		streaming.Add(2)
+		go func(stop chan struct{}) {
+			defer streaming.Done()
+			if job.Stream(c, &writeMu, offset, stop) {
+				writeMu.Lock()
+				h.closeWS(c)
+				writeMu.Unlock()
+			}
+		}(stop)
+		go func(stop chan struct{}, credits chan struct{}) {
+			defer streaming.Done()
+			sendCredits(c, &writeMu, credits, stop)
+		}(stop, credits)
+	}
+	detach := func() {
+		if stop != nil {
+			close(stop)
+			stop = nil
+		}
+		streaming.Wait()
+	}
+
+	identity := requestIdentity(r)
 	defer c.Close()
+	defer detach()
 	for {
 		m := msg.CommandRequest{}
-		err := c.ReadJSON(&m)
+		_, content, err := c.ReadMessage()
+		if err == nil {
+			err = json.Unmarshal(content, &m)
+		}
 		if err != nil && (websocket.IsCloseError(err) || websocket.IsUnexpectedCloseError(err)) {
 			logs.WithE(err).Info("Socket closed")
 			break
@@ -42,38 +126,246 @@ func (h *Handler) ExecRemoteCmd(w http.ResponseWriter, r *http.Request) {
 		}
 		cmdName := m.Content
 		if m.Type == "exec" || m.Type == "command" {
-			cmdName := m.Content
-			configLocalCmd := h.ForkliftConfig.FindRemoteCommand(cmdName)
-			logs.WithField("command", configLocalCmd.Shortname).
-				WithField("args", m.Args).
-				Info("Launching command")
-			logStreamerOut := logstreamer.NewLogStreamerWs("stdout", true, *c, configLocalCmd.Path)
-			logStreamerErr := logstreamer.NewLogStreamerWs("stderr", true, *c, configLocalCmd.Path)
-			forkliftExec = runner.NewRunner(configLocalCmd.Path, configLocalCmd.Cwd, []string{""})
-			forkliftExec.Args = m.Args
-			forkliftExec.Prepare()
-			forkliftExec.SetLogger(logStreamerOut, logStreamerErr)
-			go func() {
-				forkliftExec.Start()
-				logStreamerOut.Close()
-				logStreamerErr.Close()
-				h.closeWS(c)
-			}()
+			detach()
+			configLocalCmd, found := h.config().FindRemoteCommand(cmdName)
+			if !found {
+				h.sendError(c, commandNotFound(forkliftcmd.ActionExec, cmdName))
+				continue
+			}
+			if !auth.Authorize(identity, configLocalCmd, forkliftcmd.ActionExec) {
+				h.sendError(c, forbidden(forkliftcmd.ActionExec, configLocalCmd.Shortname, ""))
+				continue
+			}
+			args, err := commandArgs(configLocalCmd, m.Args, m.Params)
+			if err != nil {
+				h.sendError(c, invalidParams(configLocalCmd.Shortname, err))
+				continue
+			}
+			m.Args = args
+			attach(h.Jobs.Start(configLocalCmd, m), 0)
+		}
+		if m.Type == "attach" {
+			detach()
+			attached := h.Jobs.Get(m.Content)
+			if attached == nil {
+				h.sendError(c, jobNotFound(m.Content))
+				continue
+			}
+			if !auth.Authorize(identity, attached.Config, forkliftcmd.ActionAttach) {
+				h.sendError(c, forbidden(forkliftcmd.ActionAttach, attached.Command, attached.ID))
+				continue
+			}
+			logs.WithField("job", attached.ID).
+				WithField("offset", m.Offset).
+				Info("Attaching to job")
+			attach(attached, m.Offset)
+		}
+		if m.Type == "detach" {
+			detach()
+			if job == nil && m.Content != "" {
+				other := h.Jobs.Get(m.Content)
+				if other == nil {
+					h.sendError(c, jobNotFound(m.Content))
+					continue
+				}
+				if !auth.Authorize(identity, other.Config, forkliftcmd.ActionAttach) {
+					h.sendError(c, forbidden(forkliftcmd.ActionAttach, other.Command, other.ID))
+					continue
+				}
+				other.DetachAll()
+			}
+			detachedMsg := msg.Message{Type: "detached", Content: m.Content}
+			if job != nil {
+				detachedMsg.Content = job.ID
+				logs.WithField("job", job.ID).Info("Detaching from job")
+			}
+			_ = detachedMsg.Send(c)
+			h.closeWS(c)
+		}
+		if m.Type == "list" {
+			detach()
+			jobsMsg := msg.JobList{Message: msg.Message{Type: "jobs"}, Jobs: []msg.JobInfo{}}
+			for _, listed := range h.Jobs.List() {
+				if listed.Config.Allows(identity.Name, identity.Groups, forkliftcmd.ActionAttach) {
+					jobsMsg.Jobs = append(jobsMsg.Jobs, listed.Info())
+				}
+			}
+			_ = jobsMsg.Send(c)
+			h.closeWS(c)
 		}
 		if m.Type == "args" {
-			configRemoteCmd := h.ForkliftConfig.FindLocalCommand(cmdName)
-			logs.WithField("args", configRemoteCmd.Args).Debug("Gettings Args")
-			argsMsg := msg.Message{Type: "args", Content: configRemoteCmd.Args}
+			detach()
+			configRemoteCmd, found := h.config().FindRemoteCommand(cmdName)
+			if !found {
+				h.sendError(c, commandNotFound(forkliftcmd.ActionArgs, cmdName))
+				continue
+			}
+			if !auth.Authorize(identity, configRemoteCmd, forkliftcmd.ActionArgs) {
+				h.sendError(c, forbidden(forkliftcmd.ActionArgs, configRemoteCmd.Shortname, ""))
+				continue
+			}
+			args := configRemoteCmd.Mask(configRemoteCmd.Args.String())
+			logs.WithField("args", args).Debug("Gettings Args")
+			argsMsg := msg.Message{Type: "args", Content: args}
 			_ = argsMsg.Send(c)
 			h.closeWS(c)
 		}
+		if job == nil {
+			continue
+		}
+		if m.Type == "stdin" {
+			input := msg.CommandInput{}
+			if err := json.Unmarshal(content, &input); err != nil {
+				logs.WithE(err).Error("Error reading stdin message.")
+				continue
+			}
+			// a client sending past its window waits for the command, and so does its socket
+			select {
+			case window <- struct{}{}:
+			case <-job.Done():
+				continue
+			}
+			window, credits := window, credits
+			job.WriteStdin(input.Data, func() {
+				<-window
+				select {
+				case credits <- struct{}{}:
+				default:
+				}
+			})
+		}
+		if m.Type == "stdin-eof" {
+			job.CloseStdin()
+		}
+		if m.Type == "resize" {
+			if err := job.Runner.Resize(m.Rows, m.Cols); err != nil {
+				logs.WithE(err).Debug("Failed to resize terminal")
+			}
+		}
 		if m.Type == "kill" {
-			logs.WithField("command", cmdName).Info("Killing command")
-			forkliftExec.Stop()
+			if !auth.Authorize(identity, job.Config, forkliftcmd.ActionKill) {
+				detach()
+				h.sendError(c, forbidden(forkliftcmd.ActionKill, job.Command, job.ID))
+				continue
+			}
+			logs.WithField("job", job.ID).
+				WithField("command", job.Command).
+				Info("Killing command")
+			go job.Runner.StopBy(runner.KilledByClient)
 		}
 	}
 }
 
+// sendCredits gives their stdin window back to the client as the command reads its input.
+func sendCredits(c *websocket.Conn, writeMu *sync.Mutex, credits <-chan struct{}, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-credits:
+		}
+		creditMsg := msg.StdinCredit{Message: msg.Message{Type: "stdin-credit"}, Credit: 1}
+		for len(credits) > 0 {
+			<-credits
+			creditMsg.Credit++
+		}
+		writeMu.Lock()
+		err := creditMsg.Send(c)
+		writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// requestIdentity is the caller identity set by Authenticated, anonymous without it.
+func requestIdentity(r *http.Request) auth.Identity {
+	if identity, ok := auth.FromContext(r.Context()); ok {
+		return identity
+	}
+	return auth.Identity{Method: auth.MethodNone}
+}
+
+func forbidden(action string, command string, jobID string) msg.Error {
+	return msg.Error{
+		Message: msg.Message{Type: "error", Content: "Not allowed to " + action + " " + command},
+		Code:    msg.ErrorForbidden,
+		Action:  action,
+		Command: command,
+		Job:     jobID,
+	}
+}
+
+func invalidParams(command string, err error) msg.Error {
+	return msg.Error{
+		Message: msg.Message{Type: "error", Content: strings.TrimSpace(err.Error())},
+		Code:    msg.ErrorInvalidParams,
+		Action:  forkliftcmd.ActionExec,
+		Command: command,
+	}
+}
+
+// commandArgs returns the args to run cmdConfig with. Templated commands only
+// take params, the others run with their configured args unless they allow args.
+func commandArgs(cmdConfig forkliftcmd.ForkliftCommand, args []string, params map[string]string) ([]string, error) {
+	if !cmdConfig.Templated() {
+		if len(params) > 0 {
+			return nil, errs.WithF(data.WithField("command", cmdConfig.Shortname), "Command takes no params")
+		}
+		if len(args) > 0 && !cmdConfig.AllowArgs {
+			return nil, errs.WithF(data.WithField("command", cmdConfig.Shortname), "Command takes no args")
+		}
+		if args == nil {
+			return cmdConfig.Args, nil
+		}
+		return args, nil
+	}
+	if len(args) > 0 {
+		return nil, errs.WithF(data.WithField("command", cmdConfig.Shortname), "Command takes params, not args")
+	}
+	return cmdConfig.RenderArgs(params)
+}
+
+func commandNotFound(action string, command string) msg.Error {
+	return msg.Error{
+		Message: msg.Message{Type: "error", Content: "Unknown command: " + command},
+		Code:    msg.ErrorNotFound,
+		Action:  action,
+		Command: command,
+	}
+}
+
+func jobNotFound(jobID string) msg.Error {
+	return msg.Error{
+		Message: msg.Message{Type: "error", Content: "Unknown job: " + jobID},
+		Code:    msg.ErrorNotFound,
+		Job:     jobID,
+	}
+}
+
+// sendError replies with errorMsg and closes the socket, nothing may be streaming.
+func (h *Handler) sendError(c *websocket.Conn, errorMsg msg.Error) {
+	_ = errorMsg.Send(c)
+	h.closeWS(c)
+}
+
+func exitMessage(cmdName string, forkliftExec *runner.Runner) msg.CommandExit {
+	exitMsg := msg.CommandExit{
+		Message: msg.Message{
+			Type:    "exit",
+			Content: cmdName,
+		},
+		Code:       forkliftExec.Status,
+		DurationMs: int64(forkliftExec.Duration / time.Millisecond),
+		Reason:     forkliftExec.ExitReason,
+		KilledBy:   forkliftExec.KilledBy,
+	}
+	if forkliftExec.ExitSignal != 0 {
+		exitMsg.Signal = forkliftcmd.SignalName(forkliftExec.ExitSignal)
+	}
+	return exitMsg
+}
+
 func (h *Handler) closeWS(c *websocket.Conn) {
 	if err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); err != nil {
 		logs.WithE(err).Error("Error closing websocket")
@@ -2,10 +2,86 @@ package http
 
 import (
 	"net/http"
+	"time"
+
+	"github.com/nyodas/forklift/supervisor"
+)
+
+const (
+	HealthOK   = "ok"
+	HealthFail = "fail"
 )
 
+type commandHealth struct {
+	Name             string
+	State            string
+	Critical         bool
+	Live             bool
+	Ready            bool
+	ExitCode         *int       `json:",omitempty"`
+	RetriesExhausted bool       `json:",omitempty"`
+	Health           string     `json:",omitempty"`
+	Failures         int        `json:",omitempty"`
+	LastCheck        *time.Time `json:",omitempty"`
+	LastError        string     `json:",omitempty"`
+}
+
+type healthStatus struct {
+	Status   string
+	Commands []commandHealth
+}
+
+// Healthz is the liveness endpoint, it fails when a critical command exited or is unhealthy.
 func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
+	h.writeHealth(w, func(command commandHealth) bool { return command.Live })
+}
+
+// Readyz is the readiness endpoint, it fails until every command runs and passes its health check.
+func (h *Handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	h.writeHealth(w, func(command commandHealth) bool { return command.Ready })
+}
+
+func (h *Handler) writeHealth(w http.ResponseWriter, ok func(command commandHealth) bool) {
+	status := healthStatus{Status: HealthOK, Commands: h.commandsHealth()}
+	for _, command := range status.Commands {
+		if !ok(command) {
+			status.Status = HealthFail
+		}
+	}
 	statusCode := http.StatusOK
-	w.WriteHeader(statusCode)
-	w.Write(nil)
+	if status.Status != HealthOK {
+		statusCode = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, statusCode, status)
+}
+
+func (h *Handler) commandsHealth() []commandHealth {
+	commands := []commandHealth{}
+	if h.Supervisor == nil {
+		return commands
+	}
+	for _, service := range h.Supervisor.List() {
+		health := service.Health()
+		command := commandHealth{
+			Name:      service.Name,
+			State:     service.State(),
+			Critical:  service.Critical,
+			Live:      service.Live(),
+			Ready:     service.Ready(),
+			Health:    health.Status,
+			Failures:  health.Failures,
+			LastError: health.LastError,
+		}
+		if command.State != supervisor.StateRunning {
+			exitCode := service.Runner.Status
+			command.ExitCode = &exitCode
+			command.RetriesExhausted = service.Runner.RetriesExhausted
+		}
+		if !health.LastCheck.IsZero() {
+			command.LastCheck = &health.LastCheck
+		}
+		commands = append(commands, command)
+	}
+	return commands
 }
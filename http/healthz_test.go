@@ -0,0 +1,45 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nyodas/forklift/forkliftcmd"
+	"github.com/nyodas/forklift/supervisor"
+	"github.com/stretchr/testify/assert"
+)
+
+func healthOf(t *testing.T, handler http.HandlerFunc) (int, healthStatus) {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/", nil))
+	status := healthStatus{}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	return recorder.Code, status
+}
+
+func TestHealthz(t *testing.T) {
+	handler := &Handler{}
+	code, status := healthOf(t, handler.Healthz)
+	assert.Equal(t, http.StatusOK, code, "No supervised command is healthy")
+	assert.Equal(t, HealthOK, status.Status)
+
+	handler.Supervisor = supervisor.NewSupervisor()
+	critical, err := handler.Supervisor.Add(forkliftcmd.ForkliftCommand{Shortname: "critical", Path: "/bin/sh", Args: forkliftcmd.Args{"-c", "exit 3"}, Cwd: "/", Oneshot: true, Critical: true})
+	assert.NoError(t, err)
+	<-critical.Done()
+
+	code, status = healthOf(t, handler.Healthz)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, HealthFail, status.Status)
+	if assert.Len(t, status.Commands, 1) {
+		assert.Equal(t, "critical", status.Commands[0].Name)
+		assert.Equal(t, supervisor.StateExited, status.Commands[0].State)
+		if assert.NotNil(t, status.Commands[0].ExitCode) {
+			assert.Equal(t, 3, *status.Commands[0].ExitCode)
+		}
+	}
+	code, _ = healthOf(t, handler.Readyz)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
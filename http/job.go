@@ -0,0 +1,379 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/nyodas/forklift/forkliftcmd"
+	"github.com/nyodas/forklift/logstreamer"
+	"github.com/nyodas/forklift/msg"
+	"github.com/nyodas/forklift/runner"
+)
+
+const (
+	// DefaultJobRetention is how long a finished job stays available for attach.
+	DefaultJobRetention = 10 * time.Minute
+	// maxJobOutput is the number of output messages kept per job, older ones are dropped.
+	maxJobOutput = 10000
+)
+
+// Job is a remote command execution, its output is buffered so clients
+// can attach, detach and resume from an offset while it runs.
+type Job struct {
+	ID        string
+	Command   string
+	Args      []string
+	StartedAt time.Time
+	Config    forkliftcmd.ForkliftCommand
+	Runner    *runner.Runner
+
+	mu      sync.Mutex
+	output  [][]byte
+	first   int64
+	exit    *msg.CommandExit
+	update  chan struct{}
+	done    chan struct{}
+	stdin   *stdinForwarder
+	clients map[chan struct{}]struct{}
+	metrics *Metrics
+}
+
+// JobRegistry keeps the jobs started through the websocket.
+type JobRegistry struct {
+	Retention time.Duration
+	Metrics   *Metrics
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+func NewJobRegistry() *JobRegistry {
+	return &JobRegistry{
+		Retention: DefaultJobRetention,
+		jobs:      make(map[string]*Job),
+	}
+}
+
+func newJobID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		logs.WithE(err).Error("Failed to generate job id")
+	}
+	return hex.EncodeToString(id)
+}
+
+// Start runs a remote command as a new job.
+func (r *JobRegistry) Start(cmdConfig forkliftcmd.ForkliftCommand, request msg.CommandRequest) *Job {
+	job := &Job{
+		ID:        newJobID(),
+		Command:   cmdConfig.Shortname,
+		Args:      request.Args,
+		StartedAt: time.Now(),
+		Config:    cmdConfig,
+		Runner:    runner.NewRunnerFromConfig(cmdConfig),
+		update:    make(chan struct{}),
+		done:      make(chan struct{}),
+		clients:   make(map[chan struct{}]struct{}),
+		metrics:   r.Metrics,
+	}
+	forkliftExec := job.Runner
+	forkliftExec.Args = request.Args
+	for name, value := range request.Env {
+		if !cmdConfig.AllowsRemoteEnv(name) {
+			logs.WithField("command", cmdConfig.Shortname).
+				WithField("env", name).
+				Warn("Remote env variable not allowed, ignoring")
+			continue
+		}
+		forkliftExec.Environment.Env[name] = value
+	}
+	logStreamerOut := logstreamer.NewLogStreamerMsg("stdout", false, job, cmdConfig.Path)
+	logStreamerErr := logstreamer.NewLogStreamerMsg("stderr", false, job, cmdConfig.Path)
+	if cmdConfig.TTY {
+		forkliftExec.SetTTYOutput(logstreamer.NewRawStreamerMsg(job))
+	}
+	forkliftExec.Prepare()
+	forkliftExec.SetLogger(logStreamerOut, logStreamerErr)
+	if request.Stdin {
+		if pipe, err := forkliftExec.StdinPipe(); err != nil {
+			logs.WithE(err).Warn("Failed to open command stdin")
+		} else {
+			job.stdin = newStdinForwarder(pipe)
+		}
+	}
+	if cmdConfig.TTY && request.Rows > 0 && request.Cols > 0 {
+		if err := forkliftExec.Resize(request.Rows, request.Cols); err != nil {
+			logs.WithE(err).Warn("Failed to set terminal size")
+		}
+	}
+
+	r.mu.Lock()
+	r.jobs[job.ID] = job
+	r.mu.Unlock()
+	logs.WithField("job", job.ID).
+		WithField("command", job.Command).
+		WithField("args", job.Config.MaskArgs(job.Args)).
+		Info("Launching command")
+	go func() {
+		forkliftExec.Start()
+		logStreamerOut.Close()
+		logStreamerErr.Close()
+		job.finish(exitMessage(job.Command, forkliftExec))
+		time.AfterFunc(r.Retention, func() {
+			r.remove(job.ID)
+		})
+	}()
+	return job
+}
+
+func (r *JobRegistry) Get(id string) *Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.jobs[id]
+}
+
+// List returns the jobs, oldest first.
+func (r *JobRegistry) List() []*Job {
+	r.mu.Lock()
+	jobs := make([]*Job, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		jobs = append(jobs, job)
+	}
+	r.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt.Before(jobs[j].StartedAt)
+	})
+	return jobs
+}
+
+// StopAll stops the running jobs, signaling their process group until they exit.
+func (r *JobRegistry) StopAll() {
+	var wg sync.WaitGroup
+	for _, job := range r.List() {
+		wg.Add(1)
+		go func(job *Job) {
+			defer wg.Done()
+			job.Runner.StopBy(runner.KilledByShutdown)
+			<-job.Done()
+		}(job)
+	}
+	wg.Wait()
+}
+
+func (r *JobRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.jobs, id)
+}
+
+// Publish buffers an output message and wakes up the attached clients.
+func (j *Job) Publish(message interface{}) error {
+	switch output := message.(type) {
+	case *msg.CommandOutputLog:
+		j.metrics.Output(j.Command, output.Prefix, len(output.Content))
+	case *msg.CommandOutputRaw:
+		j.metrics.Output(j.Command, "tty", len(output.Data))
+	}
+	content, err := json.Marshal(message)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("job", j.ID), "Failed to marshal job output")
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.append(content)
+	return nil
+}
+
+func (j *Job) append(content []byte) {
+	j.output = append(j.output, content)
+	if len(j.output) > maxJobOutput {
+		dropped := len(j.output) - maxJobOutput
+		j.output = append([][]byte(nil), j.output[dropped:]...)
+		j.first += int64(dropped)
+	}
+	close(j.update)
+	j.update = make(chan struct{})
+}
+
+func (j *Job) finish(exitMsg msg.CommandExit) {
+	logs.WithField("job", j.ID).
+		WithField("command", j.Command).
+		WithField("exitcode", exitMsg.Code).
+		WithField("killedBy", exitMsg.KilledBy).
+		Info("Command ended")
+	content, err := json.Marshal(&exitMsg)
+	if err != nil {
+		logs.WithE(err).WithField("job", j.ID).Error("Failed to marshal exit message")
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// the exit message and the finished state are seen together by readers
+	j.exit = &exitMsg
+	if content != nil {
+		j.append(content)
+	} else {
+		close(j.update)
+		j.update = make(chan struct{})
+	}
+	if j.stdin != nil {
+		j.stdin.Close()
+		j.stdin = nil
+	}
+	close(j.done)
+}
+
+// read returns the output from offset, the offset following it and a channel
+// closed on the next output. An offset already dropped starts at the oldest kept.
+func (j *Job) read(offset int64) (output [][]byte, start int64, next int64, update chan struct{}, finished bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if offset < j.first {
+		offset = j.first
+	}
+	end := j.first + int64(len(j.output))
+	if offset > end {
+		offset = end
+	}
+	return j.output[offset-j.first:], offset, end, j.update, j.exit != nil
+}
+
+// Stream sends the output of the job to c from offset until it ends or stop is closed,
+// holding writeMu for each message. It returns true when the client is done with the job:
+// the whole output, exit message included, was sent or it was detached by another client.
+func (j *Job) Stream(c *websocket.Conn, writeMu *sync.Mutex, offset int64, stop chan struct{}) bool {
+	detach := j.attach()
+	defer j.detach(detach)
+	send := func(message msg.MessageSender) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return message.Send(c)
+	}
+	_, start, _, _, _ := j.read(offset)
+	attachedMsg := msg.JobAttached{
+		Message: msg.Message{
+			Type:    "attached",
+			Content: j.ID,
+		},
+		Offset: start,
+	}
+	if err := send(&attachedMsg); err != nil {
+		return false
+	}
+	_, finished, err := j.each(start, true, stop, detach, func(_ int64, content []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return c.WriteMessage(websocket.TextMessage, content)
+	})
+	if err != nil {
+		logs.WithE(err).WithField("job", j.ID).Debug("Failed to stream job output")
+		return false
+	}
+	select {
+	case <-detach:
+		_ = send(&msg.Message{Type: "detached", Content: j.ID})
+		return true
+	default:
+	}
+	return finished
+}
+
+// each calls send for every output message from offset and, when following,
+// waits for the next ones until the job finished or stop or detach are closed.
+// It returns the offset following the last message sent.
+func (j *Job) each(offset int64, follow bool, stop <-chan struct{}, detach <-chan struct{},
+	send func(offset int64, content []byte) error) (next int64, finished bool, err error) {
+	output, start, next, update, finished := j.read(offset)
+	for {
+		for i, content := range output {
+			if err := send(start+int64(i), content); err != nil {
+				return start + int64(i), false, err
+			}
+		}
+		if finished || !follow {
+			return next, finished, nil
+		}
+		select {
+		case <-update:
+		case <-stop:
+			return next, false, nil
+		case <-detach:
+			return next, false, nil
+		}
+		output, start, next, update, finished = j.read(next)
+	}
+}
+
+func (j *Job) attach() chan struct{} {
+	detach := make(chan struct{})
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.clients[detach] = struct{}{}
+	return detach
+}
+
+func (j *Job) detach(detach chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.clients, detach)
+}
+
+// DetachAll stops the output streams of every attached client, the job keeps running.
+func (j *Job) DetachAll() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for detach := range j.clients {
+		close(detach)
+		delete(j.clients, detach)
+	}
+}
+
+// WriteStdin forwards input to the command when it was started with stdin,
+// written is called once the command got it.
+func (j *Job) WriteStdin(input []byte, written func()) {
+	j.mu.Lock()
+	stdin := j.stdin
+	j.mu.Unlock()
+	if stdin == nil {
+		written()
+		return
+	}
+	stdin.Write(input, written)
+}
+
+// CloseStdin sends an EOF to the command.
+func (j *Job) CloseStdin() {
+	j.mu.Lock()
+	stdin := j.stdin
+	j.stdin = nil
+	j.mu.Unlock()
+	if stdin != nil {
+		stdin.Close()
+	}
+}
+
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+func (j *Job) Info() msg.JobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return msg.JobInfo{
+		ID:        j.ID,
+		Command:   j.Command,
+		Args:      j.Config.MaskArgs(j.Args),
+		StartedAt: j.StartedAt,
+		Running:   j.exit == nil,
+		Clients:   len(j.clients),
+		Offset:    j.first + int64(len(j.output)),
+		Exit:      j.exit,
+	}
+}
@@ -0,0 +1,319 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nyodas/forklift/forkliftcmd"
+	"github.com/nyodas/forklift/msg"
+	"github.com/nyodas/forklift/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+func testServer(t *testing.T) (*Handler, string) {
+	handler := &Handler{
+		ForkliftConfig: &forkliftcmd.ForkliftCommandConfig{
+			RemoteConfig: []forkliftcmd.ForkliftCommand{
+				{Shortname: "sh", Path: "/bin/sh", Cwd: "/", AllowArgs: true},
+			},
+		},
+		Jobs: NewJobRegistry(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler.ExecRemoteCmd))
+	t.Cleanup(server.Close)
+	return handler, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// exchange sends request and returns the messages received until the socket closes.
+func exchange(t *testing.T, url string, request msg.CommandRequest) []map[string]interface{} {
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer c.Close()
+	assert.NoError(t, request.Send(c))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var messages []map[string]interface{}
+	for {
+		_, content, err := c.ReadMessage()
+		if err != nil {
+			assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), "Socket should be closed normally: %s", err)
+			return messages
+		}
+		m := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(content, &m))
+		messages = append(messages, m)
+	}
+}
+
+func TestExecJob(t *testing.T) {
+	handler, url := testServer(t)
+	messages := exchange(t, url, msg.CommandRequest{
+		Message: msg.Message{Type: "exec", Content: "sh"},
+		Args:    []string{"-c", "echo one; echo two; exit 3"},
+	})
+	if assert.Len(t, messages, 4) {
+		assert.Equal(t, "attached", messages[0]["Type"])
+		assert.Equal(t, "one\n", messages[1]["Content"])
+		assert.Equal(t, "two\n", messages[2]["Content"])
+		assert.Equal(t, "exit", messages[3]["Type"])
+		assert.Equal(t, float64(3), messages[3]["Code"])
+	}
+
+	jobs := handler.Jobs.List()
+	if assert.Len(t, jobs, 1) {
+		<-jobs[0].Done()
+		info := jobs[0].Info()
+		assert.False(t, info.Running)
+		assert.Equal(t, int64(3), info.Offset)
+
+		messages = exchange(t, url, msg.CommandRequest{
+			Message: msg.Message{Type: "attach", Content: info.ID},
+			Offset:  1,
+		})
+		if assert.Len(t, messages, 3, "Attach should resume from the offset") {
+			assert.Equal(t, float64(1), messages[0]["Offset"])
+			assert.Equal(t, "two\n", messages[1]["Content"])
+			assert.Equal(t, "exit", messages[2]["Type"])
+		}
+	}
+}
+
+func TestDetachAndList(t *testing.T) {
+	handler, url := testServer(t)
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.NoError(t, err)
+	defer c.Close()
+	request := msg.CommandRequest{
+		Message: msg.Message{Type: "exec", Content: "sh"},
+		Args:    []string{"-c", "sleep 30"},
+	}
+	assert.NoError(t, request.Send(c))
+	attached := msg.JobAttached{}
+	assert.NoError(t, c.ReadJSON(&attached))
+
+	messages := exchange(t, url, msg.CommandRequest{Message: msg.Message{Type: "detach", Content: attached.Content}})
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "detached", messages[0]["Type"])
+	}
+	detached := msg.Message{}
+	assert.NoError(t, c.ReadJSON(&detached))
+	assert.Equal(t, "detached", detached.Type, "Attached clients should be told they were detached")
+	_, _, err = c.ReadMessage()
+	assert.Error(t, err, "Detached clients should be disconnected")
+
+	messages = exchange(t, url, msg.CommandRequest{Message: msg.Message{Type: "list"}})
+	if assert.Len(t, messages, 1) {
+		jobs := messages[0]["Jobs"].([]interface{})
+		if assert.Len(t, jobs, 1) {
+			assert.Equal(t, attached.Content, jobs[0].(map[string]interface{})["ID"])
+			assert.Equal(t, true, jobs[0].(map[string]interface{})["Running"], "Detached jobs should keep running")
+		}
+	}
+	job := handler.Jobs.Get(attached.Content)
+	job.Runner.Stop()
+	<-job.Done()
+}
+
+func TestAttachUnknownJob(t *testing.T) {
+	_, url := testServer(t)
+	messages := exchange(t, url, msg.CommandRequest{Message: msg.Message{Type: "attach", Content: "nope"}})
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "error", messages[0]["Type"])
+	}
+}
+
+func TestJobDropsOldOutput(t *testing.T) {
+	job := &Job{update: make(chan struct{})}
+	for i := 0; i < maxJobOutput+5; i++ {
+		assert.NoError(t, job.Publish(&msg.Message{Type: "log"}))
+	}
+	output, start, next, _, finished := job.read(0)
+	assert.Len(t, output, maxJobOutput)
+	assert.Equal(t, int64(5), start, "Dropped output should be skipped")
+	assert.Equal(t, int64(maxJobOutput+5), next)
+	assert.False(t, finished)
+}
+
+func TestStopAllJobs(t *testing.T) {
+	jobs := NewJobRegistry()
+	job := jobs.Start(forkliftcmd.ForkliftCommand{Shortname: "sh", Path: "/bin/sh", Cwd: "/"},
+		msg.CommandRequest{Args: []string{"-c", "sleep 10 & wait"}})
+	time.Sleep(100 * time.Millisecond)
+	jobs.StopAll()
+	select {
+	case <-job.Done():
+	default:
+		t.Fatal("StopAll should wait for the jobs to exit")
+	}
+	if exit := job.Info().Exit; assert.NotNil(t, exit) {
+		assert.Equal(t, runner.KilledByShutdown, exit.KilledBy)
+	}
+}
+
+func TestExecParams(t *testing.T) {
+	handler, url := testServer(t)
+	handler.ForkliftConfig.RemoteConfig[0].Params = []forkliftcmd.Param{{Name: "code", Type: forkliftcmd.ParamInt, Required: true}}
+	handler.ForkliftConfig.RemoteConfig[0].ArgsTemplate = []string{"-c", "exit {{.code}}"}
+
+	messages := exchange(t, url, msg.CommandRequest{
+		Message: msg.Message{Type: "exec", Content: "sh"},
+		Params:  map[string]string{"code": "4"},
+	})
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "exit", messages[1]["Type"])
+		assert.Equal(t, float64(4), messages[1]["Code"])
+	}
+
+	for _, request := range []msg.CommandRequest{
+		{Message: msg.Message{Type: "exec", Content: "sh"}, Params: map[string]string{"code": "4; rm -rf /"}},
+		{Message: msg.Message{Type: "exec", Content: "sh"}, Args: []string{"-c", "exit 0"}},
+	} {
+		messages = exchange(t, url, request)
+		if assert.Len(t, messages, 1) {
+			assert.Equal(t, "error", messages[0]["Type"])
+			assert.Equal(t, msg.ErrorInvalidParams, messages[0]["Code"])
+		}
+	}
+	assert.Len(t, handler.Jobs.List(), 1, "Rejected requests should not start jobs")
+}
+
+func TestExecRejectsArgs(t *testing.T) {
+	handler, url := testServer(t)
+	handler.ForkliftConfig.RemoteConfig[0].AllowArgs = false
+	handler.ForkliftConfig.RemoteConfig[0].Args = forkliftcmd.Args{"-c", "exit 3"}
+
+	messages := exchange(t, url, msg.CommandRequest{
+		Message: msg.Message{Type: "exec", Content: "sh"},
+		Args:    []string{"-c", "touch /tmp/pwned"},
+	})
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "error", messages[0]["Type"])
+		assert.Equal(t, msg.ErrorInvalidParams, messages[0]["Code"])
+	}
+	assert.Empty(t, handler.Jobs.List(), "Commands without allowArgs should refuse client args")
+
+	messages = exchange(t, url, msg.CommandRequest{Message: msg.Message{Type: "exec", Content: "sh"}})
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, float64(3), messages[1]["Code"], "The configured args should be used")
+	}
+}
+
+func TestStdinSlowReader(t *testing.T) {
+	_, url := testServer(t)
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	request := msg.CommandRequest{
+		Message: msg.Message{Type: "exec", Content: "sh"},
+		Args:    []string{"-c", "sleep 1; wc -c"},
+		Stdin:   true,
+	}
+	assert.NoError(t, request.Send(c))
+
+	// ignoring the credits, the server stops reading the socket instead of dropping input
+	chunks := 8 * msg.StdinWindow
+	c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	input := msg.CommandInput{Message: msg.Message{Type: "stdin"}, Data: make([]byte, 32*1024)}
+	for i := 0; i < chunks; i++ {
+		if !assert.NoError(t, input.Send(c)) {
+			return
+		}
+	}
+	eof := msg.Message{Type: "stdin-eof"}
+	assert.NoError(t, eof.Send(c))
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var output []string
+	credits := 0
+	for {
+		m := map[string]interface{}{}
+		if err := c.ReadJSON(&m); err != nil {
+			break
+		}
+		switch m["Type"] {
+		case "log":
+			output = append(output, strings.TrimSpace(m["Content"].(string)))
+		case "stdin-credit":
+			credits += int(m["Credit"].(float64))
+		case "exit":
+			assert.Equal(t, float64(0), m["Code"])
+		}
+	}
+	assert.Equal(t, []string{fmt.Sprint(chunks * len(input.Data))}, output, "Every stdin byte should reach the command")
+	assert.True(t, credits > 0, "Written stdin should be credited back")
+}
+
+func TestKillCommandNotReadingStdin(t *testing.T) {
+	_, url := testServer(t)
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	request := msg.CommandRequest{
+		Message: msg.Message{Type: "exec", Content: "sh"},
+		Args:    []string{"-c", "sleep 30"},
+		Stdin:   true,
+	}
+	assert.NoError(t, request.Send(c))
+	attached := msg.JobAttached{}
+	assert.NoError(t, c.ReadJSON(&attached))
+
+	// the whole window, more than the pipe holds
+	c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	input := msg.CommandInput{Message: msg.Message{Type: "stdin"}, Data: make([]byte, 32*1024)}
+	for i := 0; i < msg.StdinWindow; i++ {
+		if !assert.NoError(t, input.Send(c)) {
+			return
+		}
+	}
+	kill := msg.Message{Type: "kill"}
+	assert.NoError(t, kill.Send(c))
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var types []string
+	for {
+		m := map[string]interface{}{}
+		if err := c.ReadJSON(&m); err != nil {
+			break
+		}
+		if m["Type"] == "stdin-credit" {
+			continue
+		}
+		types = append(types, m["Type"].(string))
+		if m["Type"] == "exit" {
+			assert.Equal(t, "client", m["KilledBy"], "Kill should be handled with the stdin full")
+		}
+	}
+	assert.Equal(t, []string{"exit"}, types)
+}
+
+func TestExecUnknownCommand(t *testing.T) {
+	handler, url := testServer(t)
+	handler.ForkliftConfig.SetDefaultCommand("/bin/sh", "/")
+	handler.ForkliftConfig.RemoteConfig[0].Params = []forkliftcmd.Param{{Name: "code", Type: forkliftcmd.ParamInt}}
+	handler.ForkliftConfig.RemoteConfig[0].ArgsTemplate = []string{"-c", "exit {{.code}}"}
+
+	for _, request := range []msg.CommandRequest{
+		{Message: msg.Message{Type: "exec", Content: "nope"}, Args: []string{"-c", "touch /tmp/pwned"}},
+		{Message: msg.Message{Type: "exec", Content: ""}, Args: []string{"-c", "touch /tmp/pwned"}},
+		{Message: msg.Message{Type: "args", Content: "nope"}},
+	} {
+		messages := exchange(t, url, request)
+		if assert.Len(t, messages, 1) {
+			assert.Equal(t, "error", messages[0]["Type"])
+			assert.Equal(t, msg.ErrorNotFound, messages[0]["Code"])
+			assert.Equal(t, request.Type, messages[0]["Action"])
+		}
+	}
+	assert.Empty(t, handler.Jobs.List(), "Raw args of unknown commands should never reach the default command")
+}
@@ -0,0 +1,135 @@
+package http
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/nyodas/forklift/runner"
+)
+
+// UnixScheme prefixes addresses of unix domain sockets, like unix:///run/forklift.sock.
+const UnixScheme = "unix://"
+
+// listenFdsStart is the first file descriptor passed by socket activation.
+const listenFdsStart = 3
+
+// SocketOptions sets the permissions of unix domain sockets, an empty User or Group keeps forklift's.
+type SocketOptions struct {
+	Mode  os.FileMode
+	User  string
+	Group string
+}
+
+// Listen listens on a host:port or on a unix domain socket with UnixScheme.
+// A stale socket file left at the same path is replaced.
+func Listen(addr string, socket SocketOptions) (net.Listener, error) {
+	if !strings.HasPrefix(addr, UnixScheme) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, UnixScheme)
+	fields := data.WithField("socket", path)
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, errs.WithEF(err, fields, "Failed to remove stale socket")
+		}
+	}
+	// the socket gets its permissions in a private directory before being linked
+	// at path, no one can connect to it in between
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".forklift")
+	if err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to create socket directory")
+	}
+	defer os.RemoveAll(dir)
+	bound := filepath.Join(dir, "sock")
+	listener, err := net.Listen("unix", bound)
+	if err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to listen on socket")
+	}
+	unixListener := listener.(*net.UnixListener)
+	unixListener.SetUnlinkOnClose(false)
+	if err := setSocketPermissions(bound, socket); err != nil {
+		listener.Close()
+		return nil, errs.WithEF(err, fields, "Failed to set socket permissions")
+	}
+	if err := os.Link(bound, path); err != nil {
+		listener.Close()
+		return nil, errs.WithEF(err, fields, "Failed to listen on socket")
+	}
+	return &socketListener{UnixListener: unixListener, path: path}, nil
+}
+
+// socketListener removes the socket file on Close, it was bound in another directory.
+type socketListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *socketListener) Close() error {
+	err := l.UnixListener.Close()
+	if removeErr := os.Remove(l.path); err == nil && !os.IsNotExist(removeErr) {
+		err = removeErr
+	}
+	return err
+}
+
+func setSocketPermissions(path string, socket SocketOptions) error {
+	if err := os.Chmod(path, socket.Mode); err != nil {
+		return err
+	}
+	if socket.User == "" && socket.Group == "" {
+		return nil
+	}
+	uid, gid, err := runner.ResolveOwner(socket.User, socket.Group)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// ActivationListeners returns the listeners passed by systemd socket activation
+// through LISTEN_PID and LISTEN_FDS, none when forklift was not socket activated.
+func ActivationListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, errs.WithEF(err, data.WithField("LISTEN_FDS", os.Getenv("LISTEN_FDS")), "Invalid LISTEN_FDS")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// the commands must not think they are socket activated too
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := []net.Listener{}
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errs.WithEF(err, data.WithField("fd", fd).WithField("name", name), "Inherited fd is not a listener")
+		}
+		logs.WithField("fd", fd).WithField("name", name).WithField("addr", listener.Addr()).Info("Using inherited listener")
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
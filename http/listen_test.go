@@ -0,0 +1,62 @@
+package http
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "forklift.sock")
+	// a socket file left behind like a crash would
+	stale, err := net.Listen("unix", path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := Listen(UnixScheme+path, SocketOptions{Mode: 0600})
+	if !assert.NoError(t, err, "Stale sockets should be replaced") {
+		return
+	}
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	c, err := net.Dial("unix", path)
+	if assert.NoError(t, err) {
+		c.Close()
+	}
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "The directory the socket was bound in should be removed")
+	listener.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "Closing should remove the socket")
+
+	file := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, ioutil.WriteFile(file, nil, 0600))
+	_, err = Listen(UnixScheme+file, SocketOptions{Mode: 0600})
+	assert.Error(t, err, "Regular files should not be replaced")
+
+	_, err = Listen(UnixScheme+path, SocketOptions{Mode: 0600, User: "forklift-no-such-user"})
+	assert.Error(t, err)
+}
+
+func TestActivationListeners(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	listeners, err := ActivationListeners()
+	assert.NoError(t, err)
+	assert.Empty(t, listeners, "Fds passed to another process should be ignored")
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "x")
+	_, err = ActivationListeners()
+	assert.Error(t, err)
+}
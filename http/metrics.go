@@ -0,0 +1,232 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/nyodas/forklift/runner"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the command duration histogram.
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// Metrics counts what forklift does, for the Prometheus text format served by ServeMetrics.
+// It observes every runner, supervised or remote, once set with runner.SetObserver.
+// A nil Metrics ignores everything.
+type Metrics struct {
+	mu               sync.Mutex
+	restarts         map[string]float64
+	exits            map[[2]string]float64
+	timeouts         map[string]float64
+	durations        map[string]*histogram
+	outputBytes      map[[2]string]float64
+	connections      int64
+	connectionsTotal float64
+}
+
+type histogram struct {
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		restarts:    make(map[string]float64),
+		exits:       make(map[[2]string]float64),
+		timeouts:    make(map[string]float64),
+		durations:   make(map[string]*histogram),
+		outputBytes: make(map[[2]string]float64),
+	}
+}
+
+func (m *Metrics) CommandExited(command string, status int, duration time.Duration, killedBy string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.exits[[2]string{command, strconv.Itoa(status)}]++
+	if killedBy == runner.KilledByTimeout {
+		m.timeouts[command]++
+	}
+	h, ok := m.durations[command]
+	if !ok {
+		h = &histogram{counts: make([]float64, len(durationBuckets))}
+		m.durations[command] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (m *Metrics) CommandRestarted(command string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.restarts[command]++
+}
+
+// Output counts bytes of a command stream sent to clients.
+func (m *Metrics) Output(command string, stream string, bytes int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outputBytes[[2]string{command, outputStream(stream)}] += float64(bytes)
+}
+
+// outputStream bounds the stream label to stdout, stderr and tty, whatever the prefix of the output.
+func outputStream(prefix string) string {
+	switch prefix {
+	case "stderr", "tty":
+		return prefix
+	}
+	return "stdout"
+}
+
+// Connected counts a websocket connection, the returned func is called when it closes.
+func (m *Metrics) Connected() (disconnected func()) {
+	if m == nil {
+		return func() {}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections++
+	m.connectionsTotal++
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.connections--
+	}
+}
+
+// ServeMetrics writes the metrics in the Prometheus text format.
+func (h *Handler) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	running := 0
+	if h.Jobs != nil {
+		for _, job := range h.Jobs.List() {
+			if job.Info().Running {
+				running++
+			}
+		}
+	}
+	var out bytes.Buffer
+	h.Metrics.write(&out, running)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := w.Write(out.Bytes()); err != nil {
+		logs.WithE(err).Debug("Failed to write metrics")
+	}
+}
+
+func (m *Metrics) write(out *bytes.Buffer, runningJobs int) {
+	header(out, "forklift_jobs_running", "gauge", "Remote command jobs currently running.")
+	sample(out, "forklift_jobs_running", nil, float64(runningJobs))
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	header(out, "forklift_websocket_connections", "gauge", "Websocket connections currently open.")
+	sample(out, "forklift_websocket_connections", nil, float64(m.connections))
+	header(out, "forklift_websocket_connections_total", "counter", "Websocket connections accepted.")
+	sample(out, "forklift_websocket_connections_total", nil, m.connectionsTotal)
+
+	header(out, "forklift_command_restarts_total", "counter", "Restarts of supervised commands.")
+	for _, command := range sortedKeys(m.restarts) {
+		sample(out, "forklift_command_restarts_total", []string{"command", command}, m.restarts[command])
+	}
+	header(out, "forklift_command_timeouts_total", "counter", "Commands killed by their timeout.")
+	for _, command := range sortedKeys(m.timeouts) {
+		sample(out, "forklift_command_timeouts_total", []string{"command", command}, m.timeouts[command])
+	}
+	header(out, "forklift_command_exits_total", "counter", "Command executions by exit code.")
+	for _, key := range sortedPairs(m.exits) {
+		sample(out, "forklift_command_exits_total", []string{"command", key[0], "code", key[1]}, m.exits[key])
+	}
+	header(out, "forklift_command_duration_seconds", "histogram", "Duration of command executions.")
+	for _, command := range sortedKeys(m.durations) {
+		h := m.durations[command]
+		for i, bound := range durationBuckets {
+			sample(out, "forklift_command_duration_seconds_bucket",
+				[]string{"command", command, "le", strconv.FormatFloat(bound, 'g', -1, 64)}, h.counts[i])
+		}
+		sample(out, "forklift_command_duration_seconds_bucket", []string{"command", command, "le", "+Inf"}, h.count)
+		sample(out, "forklift_command_duration_seconds_sum", []string{"command", command}, h.sum)
+		sample(out, "forklift_command_duration_seconds_count", []string{"command", command}, h.count)
+	}
+	header(out, "forklift_output_bytes_total", "counter", "Bytes of command output streamed to clients.")
+	for _, key := range sortedPairs(m.outputBytes) {
+		sample(out, "forklift_output_bytes_total", []string{"command", key[0], "stream", key[1]}, m.outputBytes[key])
+	}
+}
+
+func header(out *bytes.Buffer, name string, kind string, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one line, labels alternate names and values.
+func sample(out *bytes.Buffer, name string, labels []string, value float64) {
+	out.WriteString(name)
+	if len(labels) > 0 {
+		out.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			fmt.Fprintf(out, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		out.WriteByte('}')
+	}
+	out.WriteByte(' ')
+	out.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	out.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys(values interface{}) []string {
+	var keys []string
+	switch values := values.(type) {
+	case map[string]float64:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]*histogram:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedPairs(values map[[2]string]float64) [][2]string {
+	keys := make([][2]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
@@ -0,0 +1,81 @@
+package http
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyodas/forklift/msg"
+	"github.com/nyodas/forklift/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	handler, url := testServer(t)
+	handler.Metrics = NewMetrics()
+	handler.Jobs.Metrics = handler.Metrics
+	runner.SetObserver(handler.Metrics)
+	defer runner.SetObserver(nil)
+
+	exchange(t, url, msg.CommandRequest{
+		Message: msg.Message{Type: "exec", Content: "sh"},
+		Args:    []string{"-c", "echo hello; echo oops >&2; exit 2"},
+	})
+	<-handler.Jobs.List()[0].Done()
+	// the server side of the socket may still be closing
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		handler.Metrics.mu.Lock()
+		connections := handler.Metrics.connections
+		handler.Metrics.mu.Unlock()
+		if connections == 0 {
+			break
+		}
+	}
+	handler.Metrics.CommandRestarted("worker")
+	handler.Metrics.CommandExited("worker", 0, 2*time.Second, runner.KilledByTimeout)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	assert.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	for _, line := range []string{
+		"# TYPE forklift_command_duration_seconds histogram",
+		"forklift_jobs_running 0",
+		"forklift_websocket_connections 0",
+		"forklift_websocket_connections_total 1",
+		`forklift_command_exits_total{command="sh",code="2"} 1`,
+		`forklift_command_exits_total{command="worker",code="0"} 1`,
+		`forklift_command_restarts_total{command="worker"} 1`,
+		`forklift_command_timeouts_total{command="worker"} 1`,
+		`forklift_command_duration_seconds_bucket{command="worker",le="1"} 0`,
+		`forklift_command_duration_seconds_bucket{command="worker",le="5"} 1`,
+		`forklift_command_duration_seconds_bucket{command="worker",le="+Inf"} 1`,
+		`forklift_command_duration_seconds_sum{command="worker"} 2`,
+		`forklift_output_bytes_total{command="sh",stream="stderr"} 5`,
+		`forklift_output_bytes_total{command="sh",stream="stdout"} 6`,
+	} {
+		assert.Contains(t, string(body), line+"\n")
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.CommandRestarted("a\"b\\c\nd")
+	recorder := httptest.NewRecorder()
+	(&Handler{Metrics: metrics}).ServeMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, recorder.Body.String(), `forklift_command_restarts_total{command="a\"b\\c\nd"} 1`)
+}
+
+func TestMetricsOutputStreams(t *testing.T) {
+	metrics := NewMetrics()
+	for _, prefix := range []string{"stdout", "stderr", "tty", "[custom]"} {
+		metrics.Output("sh", prefix, 1)
+	}
+	recorder := httptest.NewRecorder()
+	(&Handler{Metrics: metrics}).ServeMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, recorder.Body.String(), `forklift_output_bytes_total{command="sh",stream="stdout"} 2`)
+	assert.Contains(t, recorder.Body.String(), `forklift_output_bytes_total{command="sh",stream="tty"} 1`)
+	assert.NotContains(t, recorder.Body.String(), "custom", "Prefixes should not add label values")
+}
@@ -0,0 +1,85 @@
+package http
+
+import (
+	"io"
+	"sync"
+
+	"github.com/n0rad/go-erlog/logs"
+)
+
+// stdinChunk is a stdin message, written is called once the command got it.
+type stdinChunk struct {
+	data    []byte
+	written func()
+}
+
+// stdinForwarder writes the stdin messages to the command in its own goroutine,
+// so a command not reading its input never blocks the websocket. Its queue is
+// bounded by the stdin window of each client, see msg.StdinWindow.
+type stdinForwarder struct {
+	mu      sync.Mutex
+	pending *sync.Cond
+	queue   []stdinChunk
+	closed  bool
+}
+
+func newStdinForwarder(stdin io.WriteCloser) *stdinForwarder {
+	f := &stdinForwarder{}
+	f.pending = sync.NewCond(&f.mu)
+	go func() {
+		var err error
+		for {
+			chunk, ok := f.next()
+			if !ok {
+				break
+			}
+			// once the command stdin failed the next chunks are only acknowledged
+			if err == nil {
+				if _, err = stdin.Write(chunk.data); err != nil {
+					logs.WithE(err).Debug("Failed to write to command stdin")
+				}
+			}
+			chunk.written()
+		}
+		stdin.Close()
+	}()
+	return f
+}
+
+// next waits for a chunk, it returns false once closed and every chunk written.
+func (f *stdinForwarder) next() (stdinChunk, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.queue) == 0 && !f.closed {
+		f.pending.Wait()
+	}
+	if len(f.queue) == 0 {
+		return stdinChunk{}, false
+	}
+	chunk := f.queue[0]
+	f.queue[0] = stdinChunk{}
+	f.queue = f.queue[1:]
+	return chunk, true
+}
+
+// Write queues data for the command without waiting for it to be read,
+// written is called once it is, or right away when stdin is closed.
+func (f *stdinForwarder) Write(data []byte, written func()) {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		written()
+		return
+	}
+	f.queue = append(f.queue, stdinChunk{data: data, written: written})
+	f.mu.Unlock()
+	f.pending.Signal()
+}
+
+// Close sends an EOF to the command once the pending input is written.
+func (f *stdinForwarder) Close() {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+	f.pending.Signal()
+}
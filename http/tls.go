@@ -0,0 +1,112 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+// DefaultCertCheckInterval is how often the certificate files are checked for changes.
+const DefaultCertCheckInterval = 10 * time.Second
+
+// CertReloader serves a certificate loaded from files that can be reloaded
+// while the server runs, a failed reload keeps the previous certificate.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	if keyFile == "" {
+		keyFile = certFile
+	}
+	reloader := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	return reloader, reloader.Reload()
+}
+
+// Reload loads the certificate files again.
+func (r *CertReloader) Reload() error {
+	modTime := r.lastModified()
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("cert", r.CertFile).WithField("key", r.KeyFile), "Failed to load certificate")
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	logs.WithField("cert", r.CertFile).Info("Certificate loaded")
+	return nil
+}
+
+func (r *CertReloader) lastModified() time.Time {
+	var last time.Time
+	for _, file := range []string{r.CertFile, r.KeyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
+
+// Watch reloads the certificate when its files change, checking every interval until stop is closed.
+func (r *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.RLock()
+			changed := !r.lastModified().Equal(r.modTime)
+			r.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				logs.WithE(err).Error("Failed to reload changed certificate, keeping the previous one")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// TLSConfig serves the certificate of r. When clientCAs returns a pool, client certificates
+// are requested and verified but not required, other authentications still apply.
+// clientCAs is called on every handshake, so reloading the CAs applies to new connections.
+func TLSConfig(r *CertReloader, clientCAs func() *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+	if clientCAs != nil {
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			pool := clientCAs()
+			if pool == nil {
+				return nil, nil
+			}
+			handshake := config.Clone()
+			handshake.GetConfigForClient = nil
+			handshake.ClientCAs = pool
+			handshake.ClientAuth = tls.VerifyClientCertIfGiven
+			return handshake, nil
+		}
+	}
+	return config
+}
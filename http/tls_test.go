@@ -0,0 +1,167 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nyodas/forklift/auth"
+	"github.com/nyodas/forklift/forkliftcmd"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert writes a self-signed certificate for name and its key in one pem file.
+func writeCert(t *testing.T, path string, name string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	content := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...)
+	assert.NoError(t, ioutil.WriteFile(path, content, 0600))
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+func servedCert(t *testing.T, r *CertReloader) string {
+	cert, err := r.GetCertificate(nil)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.pem")
+	writeCert(t, path, "first")
+	reloader, err := NewCertReloader(path, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "first", servedCert(t, reloader))
+
+	writeCert(t, path, "second")
+	assert.NoError(t, reloader.Reload())
+	assert.Equal(t, "second", servedCert(t, reloader))
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("garbage"), 0600))
+	assert.Error(t, reloader.Reload())
+	assert.Equal(t, "second", servedCert(t, reloader), "Failed reloads should keep the previous certificate")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go reloader.Watch(10*time.Millisecond, stop)
+	writeCert(t, path, "third")
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, later, later))
+	deadline := time.Now().Add(5 * time.Second)
+	for servedCert(t, reloader) != "third" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "third", servedCert(t, reloader), "Changed files should be reloaded")
+}
+
+func TestTLSConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.pem")
+	serverCert := writeCert(t, path, "forklift")
+	reloader, err := NewCertReloader(path, path)
+	assert.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &http.Server{
+		TLSConfig: TLSConfig(reloader, nil),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get("https://" + listener.Addr().String())
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+	_, err = http.Get("https://" + listener.Addr().String())
+	assert.Error(t, err, "Unknown certificates should be rejected by default")
+}
+
+func TestTLSConfigReloadsClientCAs(t *testing.T) {
+	dir := t.TempDir()
+	serverPath := filepath.Join(dir, "server.pem")
+	serverCert := writeCert(t, serverPath, "forklift")
+	reloader, err := NewCertReloader(serverPath, serverPath)
+	assert.NoError(t, err)
+	clients := map[string]string{}
+	handler := &Handler{}
+	for _, name := range []string{"old", "new"} {
+		clients[name] = filepath.Join(dir, name+".pem")
+		writeCert(t, clients[name], name)
+	}
+	useCA := func(name string) {
+		authenticator, err := auth.NewAuthenticator(forkliftcmd.Auth{ClientCA: clients[name]})
+		assert.NoError(t, err)
+		handler.Reload(handler.ForkliftConfig, authenticator)
+	}
+	useCA("old")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &http.Server{
+		TLSConfig: TLSConfig(reloader, handler.ClientCAs),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.TLS.VerifiedChains) == 0 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert)
+	// verified tells if the client certificate of name was verified by the server
+	verified := func(name string) bool {
+		cert, err := tls.LoadX509KeyPair(clients[name], clients[name])
+		assert.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}}}}
+		resp, err := client.Get("https://" + listener.Addr().String())
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusNoContent
+	}
+	assert.True(t, verified("old"))
+	assert.False(t, verified("new"))
+
+	useCA("new")
+	assert.True(t, verified("new"), "Certificates of the reloaded CA should be accepted")
+	assert.False(t, verified("old"), "Certificates of the removed CA should be rejected")
+}
@@ -6,36 +6,36 @@ import (
 	"io"
 	"strings"
 
-	"github.com/gorilla/websocket"
 	"github.com/nyodas/forklift/msg"
 )
 
-type LogStreamerWs struct {
+// LogStreamerMsg publishes a command output line by line as log messages.
+type LogStreamerMsg struct {
 	LoggerStdout *LogStreamerTerm
 	LoggerStderr *LogStreamerTerm
 	buf          *bytes.Buffer
 	// if true, saves output in memory
-	record  bool
-	persist string
-	prefix  string
-	ws      websocket.Conn
+	record    bool
+	persist   string
+	prefix    string
+	publisher Publisher
 }
 
-func NewLogStreamerWs(prefix string, record bool, wsConn websocket.Conn, name string) *LogStreamerWs {
-	streamer := &LogStreamerWs{
+func NewLogStreamerMsg(prefix string, record bool, publisher Publisher, name string) *LogStreamerMsg {
+	streamer := &LogStreamerMsg{
 		LoggerStdout: NewLogStreamerTerm("stdout", false, name),
 		LoggerStderr: NewLogStreamerTerm("stderr", false, name),
 		buf:          bytes.NewBuffer([]byte("")),
 		prefix:       prefix,
 		record:       record,
-		ws:           wsConn,
+		publisher:    publisher,
 		persist:      "",
 	}
 
 	return streamer
 }
 
-func (l *LogStreamerWs) Write(p []byte) (n int, err error) {
+func (l *LogStreamerMsg) Write(p []byte) (n int, err error) {
 	if n, err = l.buf.Write(p); err != nil {
 		return
 	}
@@ -44,7 +44,7 @@ func (l *LogStreamerWs) Write(p []byte) (n int, err error) {
 	return
 }
 
-func (l *LogStreamerWs) Close() error {
+func (l *LogStreamerMsg) Close() error {
 	if err := l.Flush(); err != nil {
 		return err
 	}
@@ -52,17 +52,13 @@ func (l *LogStreamerWs) Close() error {
 	return nil
 }
 
-func (l *LogStreamerWs) Flush() error {
-	var p []byte
-	if _, err := l.buf.Read(p); err != nil {
-		return err
-	}
-
-	l.out(string(p))
+func (l *LogStreamerMsg) Flush() error {
+	l.out(l.buf.String())
+	l.buf.Reset()
 	return nil
 }
 
-func (l *LogStreamerWs) OutputLines() error {
+func (l *LogStreamerMsg) OutputLines() error {
 	for {
 		line, err := l.buf.ReadString('\n')
 
@@ -91,13 +87,13 @@ func (l *LogStreamerWs) OutputLines() error {
 	return nil
 }
 
-func (l *LogStreamerWs) FlushRecord() string {
+func (l *LogStreamerMsg) FlushRecord() string {
 	buffer := l.persist
 	l.persist = ""
 	return buffer
 }
 
-func (l *LogStreamerWs) out(str string) {
+func (l *LogStreamerMsg) out(str string) {
 	if len(str) < 1 {
 		return
 	}
@@ -112,7 +108,7 @@ func (l *LogStreamerWs) out(str string) {
 		l.persist = l.persist + str
 	}
 
-	if err := logMsg.Send(&l.ws); err != nil {
+	if err := l.publisher.Publish(&logMsg); err != nil {
 		fmt.Println(err)
 	}
 	if l.prefix == "stdout" {
@@ -7,3 +7,8 @@ type LogStreamer interface {
 	OutputLines() error
 	FlushRecord() string
 }
+
+// Publisher receives the protocol messages built from a command output.
+type Publisher interface {
+	Publish(message interface{}) error
+}
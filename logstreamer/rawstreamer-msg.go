@@ -0,0 +1,29 @@
+package logstreamer
+
+import (
+	"github.com/nyodas/forklift/msg"
+)
+
+// RawStreamerMsg publishes terminal output as it comes, without line buffering.
+type RawStreamerMsg struct {
+	publisher Publisher
+}
+
+func NewRawStreamerMsg(publisher Publisher) *RawStreamerMsg {
+	return &RawStreamerMsg{
+		publisher: publisher,
+	}
+}
+
+func (l *RawStreamerMsg) Write(p []byte) (n int, err error) {
+	rawMsg := msg.CommandOutputRaw{
+		Message: msg.Message{
+			Type: "tty",
+		},
+		Data: append([]byte(nil), p...),
+	}
+	if err = l.publisher.Publish(&rawMsg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
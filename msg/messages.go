@@ -2,6 +2,7 @@ package msg
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/n0rad/go-erlog/logs"
@@ -19,6 +20,69 @@ type Message struct {
 type CommandRequest struct {
 	Message
 	Args []string
+	Env  map[string]string `json:",omitempty"`
+	// Params are the typed parameters of commands rendering their args from a template.
+	Params map[string]string `json:",omitempty"`
+	// Stdin keeps the command stdin open for stdin messages until stdin-eof.
+	Stdin bool `json:",omitempty"`
+	// Offset is the first output message to replay on attach.
+	Offset int64 `json:",omitempty"`
+	TerminalSize
+}
+
+// JobAttached starts the output of a job, Content is the job ID.
+// Offset is the one of the first message sent, every output message after it increments it.
+type JobAttached struct {
+	Message
+	Offset int64
+}
+
+// Error reports a rejected request, Code is meant for programs and Content for humans.
+type Error struct {
+	Message
+	Code    string
+	Action  string `json:",omitempty"`
+	Command string `json:",omitempty"`
+	Job     string `json:",omitempty"`
+}
+
+const (
+	ErrorForbidden = "forbidden"
+	ErrorNotFound  = "not-found"
+	// ErrorInvalidParams rejects args or params not matching the command params.
+	ErrorInvalidParams = "invalid-params"
+)
+
+type JobInfo struct {
+	ID        string
+	Command   string
+	Args      []string
+	StartedAt time.Time
+	Running   bool
+	Clients   int
+	Offset    int64
+	Exit      *CommandExit `json:",omitempty"`
+}
+
+type JobList struct {
+	Message
+	Jobs []JobInfo
+}
+
+// CommandInput carries bytes for the command stdin.
+type CommandInput struct {
+	Message
+	Data []byte
+}
+
+// StdinWindow is the number of stdin messages a client sends before waiting
+// for stdin-credit messages, the server stops reading its socket past it.
+const StdinWindow = 16
+
+// StdinCredit gives back Credit stdin messages to a client, they were written to the command.
+type StdinCredit struct {
+	Message
+	Credit int
 }
 
 type CommandOutputLog struct {
@@ -26,6 +90,32 @@ type CommandOutputLog struct {
 	Prefix string
 }
 
+// CommandOutputRaw carries the raw bytes of a command running in a tty.
+type CommandOutputRaw struct {
+	Message
+	Data []byte
+}
+
+// CommandExit is the last message sent for a command.
+type CommandExit struct {
+	Message
+	Code       int
+	Signal     string `json:",omitempty"`
+	DurationMs int64
+	Reason     string
+	KilledBy   string `json:",omitempty"`
+}
+
+type TerminalSize struct {
+	Rows uint16 `json:",omitempty"`
+	Cols uint16 `json:",omitempty"`
+}
+
+type TerminalResize struct {
+	Message
+	TerminalSize
+}
+
 func Send(c *websocket.Conn, msg interface{}) (err error) {
 	messageJson, err := json.Marshal(msg)
 	if err != nil {
@@ -50,3 +140,35 @@ func (msg *CommandRequest) Send(c *websocket.Conn) (err error) {
 func (msg *CommandOutputLog) Send(c *websocket.Conn) (err error) {
 	return Send(c, msg)
 }
+
+func (msg *Error) Send(c *websocket.Conn) (err error) {
+	return Send(c, msg)
+}
+
+func (msg *JobAttached) Send(c *websocket.Conn) (err error) {
+	return Send(c, msg)
+}
+
+func (msg *JobList) Send(c *websocket.Conn) (err error) {
+	return Send(c, msg)
+}
+
+func (msg *CommandExit) Send(c *websocket.Conn) (err error) {
+	return Send(c, msg)
+}
+
+func (msg *CommandInput) Send(c *websocket.Conn) (err error) {
+	return Send(c, msg)
+}
+
+func (msg *CommandOutputRaw) Send(c *websocket.Conn) (err error) {
+	return Send(c, msg)
+}
+
+func (msg *TerminalResize) Send(c *websocket.Conn) (err error) {
+	return Send(c, msg)
+}
+
+func (msg *StdinCredit) Send(c *websocket.Conn) (err error) {
+	return Send(c, msg)
+}
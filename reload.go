@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/nyodas/forklift/auth"
+	"github.com/nyodas/forklift/forkliftcmd"
+	forkliftHttp "github.com/nyodas/forklift/http"
+	forkliftSupervisor "github.com/nyodas/forklift/supervisor"
+)
+
+// configCheckInterval is how often the config file is checked for changes.
+const configCheckInterval = 5 * time.Second
+
+// reloadable is reloaded on SIGHUP.
+type reloadable interface {
+	Reload() error
+}
+
+// configReloader applies the changes of the config files to the running daemon.
+// An invalid config is rejected as a whole and the running one kept.
+type configReloader struct {
+	path    string
+	handler *forkliftHttp.Handler
+	// supervisor runs the local commands of the config, nil when they aren't supervised
+	supervisor *forkliftSupervisor.Supervisor
+
+	mu      sync.Mutex
+	config  forkliftcmd.ForkliftCommandConfig
+	modTime time.Time
+}
+
+func newConfigReloader(path string, config forkliftcmd.ForkliftCommandConfig, handler *forkliftHttp.Handler,
+	supervisor *forkliftSupervisor.Supervisor) *configReloader {
+	r := &configReloader{
+		path:       path,
+		handler:    handler,
+		supervisor: supervisor,
+		config:     config,
+	}
+	r.modTime = modTime(r.watched()...)
+	return r
+}
+
+// modTime is the latest modification time of paths.
+func modTime(paths ...string) (latest time.Time) {
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (r *configReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.modTime = modTime(r.watched()...)
+	config, err := loadConfig(r.path)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("configfile", r.path), "Invalid config file")
+	}
+	authenticator, err := auth.NewAuthenticator(config.Auth)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("configfile", r.path), "Failed to load authentication config")
+	}
+	config.SetDefaultCommand(*commandName, *commandCwd)
+
+	added, changed, removed := forkliftcmd.DiffCommands(r.config.RemoteConfig, config.RemoteConfig)
+	logs.WithField("added", added).
+		WithField("changed", changed).
+		WithField("removed", removed).
+		Info("Reloading remote commands")
+	checkAuth(config, authenticator)
+	r.handler.Reload(&config, authenticator)
+	if r.supervisor != nil {
+		added, changed, removed = r.supervisor.Reconcile(config.LocalConfig)
+		logs.WithField("added", added).
+			WithField("changed", changed).
+			WithField("removed", removed).
+			Info("Reloaded local commands")
+	}
+	r.config = config
+	r.modTime = modTime(r.watched()...)
+	return nil
+}
+
+// watched are the config path and every file and directory of the running config.
+func (r *configReloader) watched() []string {
+	return append([]string{r.path}, r.config.Files()...)
+}
+
+// Watch reloads the config when its file changes, checking every interval until stop is closed.
+func (r *configReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.Lock()
+			changed := !modTime(r.watched()...).Equal(r.modTime)
+			r.mu.Unlock()
+			if !changed {
+				continue
+			}
+			logs.WithField("configfile", r.path).Info("Config file changed, reloading")
+			if err := r.Reload(); err != nil {
+				logs.WithE(err).Error("Failed to reload config, keeping the running one")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reloadOnHangup reloads everything on SIGHUP, in init mode the signal is still forwarded to the commands.
+func reloadOnHangup(reloadables ...reloadable) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		logs.Info("Reloading on SIGHUP")
+		for _, r := range reloadables {
+			if err := r.Reload(); err != nil {
+				logs.WithE(err).Error("Failed to reload, keeping the running config")
+			}
+		}
+	}
+}
+
+// checkAuth warns about configs letting anyone in or nobody.
+func checkAuth(config forkliftcmd.ForkliftCommandConfig, authenticator *auth.Authenticator) {
+	if !authenticator.Enabled() {
+		logs.WithField("addr", *addr).Warn("No authentication configured, anyone reaching the server can run remote commands")
+	}
+	for _, command := range config.RemoteConfig {
+		if len(command.ACL) > 0 && !authenticator.Enabled() {
+			logs.WithField("command", command.Shortname).
+				Warn("Command has an acl but no authentication is configured, every call to it will be denied")
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nyodas/forklift/forkliftcmd"
+	forkliftHttp "github.com/nyodas/forklift/http"
+	forkliftSupervisor "github.com/nyodas/forklift/supervisor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	content := "command:\n- shortname: keep\n  path: /bin/sleep\n  args: 30\n  cwd: /\n- shortname: drop\n  path: /bin/sleep\n  args: 30\n  cwd: /\nremoteCommand:\n- shortname: ls\n  path: /bin/ls\n  cwd: /\n"
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	config, err := forkliftcmd.MapConfigFile([]byte(content))
+	assert.NoError(t, err)
+	supervisor := forkliftSupervisor.NewSupervisor()
+	defer supervisor.StopAll()
+	for _, command := range config.LocalConfig {
+		_, err := supervisor.Add(command)
+		assert.NoError(t, err)
+	}
+	keep := supervisor.Get("keep")
+	handler := &forkliftHttp.Handler{ForkliftConfig: &config}
+	reloader := newConfigReloader(path, config, handler, supervisor)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("command: [nope"), 0600))
+	assert.Error(t, reloader.Reload(), "Invalid configs should be rejected")
+	assert.Len(t, supervisor.List(), 2, "The running config should be kept")
+
+	content = "command:\n- shortname: keep\n  path: /bin/sleep\n  args: 30\n  cwd: /\n- shortname: new\n  path: /bin/sleep\n  args: 30\n  cwd: /\nremoteCommand:\n- shortname: cat\n  path: /bin/cat\n  cwd: /\n"
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, later, later))
+	stop := make(chan struct{})
+	defer close(stop)
+	go reloader.Watch(10*time.Millisecond, stop)
+	deadline := time.Now().Add(5 * time.Second)
+	for supervisor.Get("new") == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotNil(t, supervisor.Get("new"), "Changed files should be reloaded")
+	assert.Nil(t, supervisor.Get("drop"))
+	assert.True(t, keep == supervisor.Get("keep"), "Unchanged commands should keep running")
+	reloader.mu.Lock()
+	cat, _ := reloader.config.FindRemoteCommand("cat")
+	reloader.mu.Unlock()
+	assert.Equal(t, "/bin/cat", cat.Path)
+}
+
+func TestConfigReloaderIncludes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	included := filepath.Join(dir, "conf.d", "team.yml")
+	assert.NoError(t, os.Mkdir(filepath.Dir(included), 0755))
+	assert.NoError(t, ioutil.WriteFile(path, []byte("include: [conf.d/*.yml]\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(included, []byte("remoteCommand:\n- shortname: ls\n  path: /bin/ls\n"), 0600))
+	config, err := loadConfig(path)
+	assert.NoError(t, err)
+	handler := &forkliftHttp.Handler{ForkliftConfig: &config}
+	reloader := newConfigReloader(path, config, handler, nil)
+
+	assert.NoError(t, ioutil.WriteFile(included, []byte("remoteCommand:\n- shortname: cat\n  path: /bin/cat\n"), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(included, later, later))
+	stop := make(chan struct{})
+	defer close(stop)
+	go reloader.Watch(10*time.Millisecond, stop)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reloader.mu.Lock()
+		cat, _ := reloader.config.FindRemoteCommand("cat")
+		reloader.mu.Unlock()
+		path := cat.Path
+		if path == "/bin/cat" || time.Now().After(deadline) {
+			assert.Equal(t, "/bin/cat", path, "Changes of included files should be reloaded")
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,266 @@
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/nyodas/forklift/forkliftcmd"
+)
+
+// cgroupDaemonLeaf receives forklift's own processes, cgroup v2 forbids
+// processes in a cgroup delegating controllers to its children.
+const cgroupDaemonLeaf = "forklift-daemon"
+
+var cgroupControllers = []string{"cpu", "memory", "pids", "io"}
+
+var cgroupParent = struct {
+	sync.Mutex
+	root        string
+	path        string
+	initialized bool
+}{}
+
+var cgroupSeq uint64
+
+// SetCgroupRoot sets the cgroup under which commands get their cgroups,
+// forklift's own cgroup is used when empty.
+func SetCgroupRoot(root string) {
+	cgroupParent.Lock()
+	defer cgroupParent.Unlock()
+	cgroupParent.root = root
+	cgroupParent.initialized = false
+}
+
+// parentCgroup returns the cgroup holding the commands ones, delegating
+// the controllers to its children on first use.
+func parentCgroup() (string, error) {
+	cgroupParent.Lock()
+	defer cgroupParent.Unlock()
+	if cgroupParent.initialized {
+		return cgroupParent.path, nil
+	}
+	path := cgroupParent.root
+	if path == "" {
+		var err error
+		if path, err = ownCgroup(); err != nil {
+			return "", err
+		}
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return "", errs.WithEF(err, data.WithField("cgroup", path), "Failed to create cgroup root")
+	}
+	if err := moveProcsToLeaf(path); err != nil {
+		return "", err
+	}
+	enableControllers(path)
+	cgroupParent.path = path
+	cgroupParent.initialized = true
+	return path, nil
+}
+
+// ownCgroup finds the cgroup v2 of forklift from /proc/self/mountinfo and /proc/self/cgroup.
+func ownCgroup() (string, error) {
+	mount, err := cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", errs.WithE(err, "Failed to read own cgroup")
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return filepath.Join(mount, strings.TrimPrefix(line, "0::")), nil
+		}
+	}
+	return "", errs.With("Forklift is not in a cgroup v2")
+}
+
+func cgroup2Mount() (string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", errs.WithE(err, "Failed to read mountinfo")
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// mount point is the 5th field, fstype follows the " - " separator
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				return fields[4], nil
+			}
+		}
+	}
+	return "", errs.With("No cgroup v2 mounted")
+}
+
+func moveProcsToLeaf(path string) error {
+	procs, err := ioutil.ReadFile(filepath.Join(path, "cgroup.procs"))
+	if err != nil || len(strings.TrimSpace(string(procs))) == 0 {
+		return nil
+	}
+	leaf := filepath.Join(path, cgroupDaemonLeaf)
+	if err := os.MkdirAll(leaf, 0755); err != nil {
+		return errs.WithEF(err, data.WithField("cgroup", leaf), "Failed to create forklift cgroup")
+	}
+	for _, pid := range strings.Fields(string(procs)) {
+		if err := writeCgroupFile(leaf, "cgroup.procs", pid); err != nil {
+			logs.WithE(err).WithField("pid", pid).Debug("Failed to move process to forklift cgroup")
+		}
+	}
+	return nil
+}
+
+func enableControllers(path string) {
+	available, _ := ioutil.ReadFile(filepath.Join(path, "cgroup.controllers"))
+	for _, controller := range cgroupControllers {
+		if !strings.Contains(" "+string(available)+" ", " "+controller+" ") {
+			continue
+		}
+		if err := writeCgroupFile(path, "cgroup.subtree_control", "+"+controller); err != nil {
+			logs.WithE(err).WithField("controller", controller).Warn("Failed to enable cgroup controller")
+		}
+	}
+}
+
+func writeCgroupFile(path string, file string, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(path, file), []byte(value), 0644); err != nil {
+		return errs.WithEF(err, data.WithField("cgroup", path).WithField("file", file).WithField("value", value),
+			"Failed to write cgroup file")
+	}
+	return nil
+}
+
+// cgroup is the cgroup of a single execution.
+type cgroup struct {
+	path string
+	dir  *os.File
+}
+
+func newCgroup(name string, limits forkliftcmd.Cgroup) (*cgroup, error) {
+	parent, err := parentCgroup()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(parent, fmt.Sprintf("%s-%d", cgroupName(name), atomic.AddUint64(&cgroupSeq, 1)))
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, errs.WithEF(err, data.WithField("cgroup", path), "Failed to create cgroup")
+	}
+	c := &cgroup{path: path}
+	if err := c.setLimits(limits); err != nil {
+		c.destroy()
+		return nil, err
+	}
+	if c.dir, err = os.Open(path); err != nil {
+		c.destroy()
+		return nil, errs.WithEF(err, data.WithField("cgroup", path), "Failed to open cgroup")
+	}
+	return c, nil
+}
+
+func cgroupName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, filepath.Base(name))
+}
+
+func (c *cgroup) setLimits(limits forkliftcmd.Cgroup) error {
+	files := []struct {
+		name  string
+		value string
+	}{
+		{"cpu.weight", uintValue(limits.CPUWeight)},
+		{"cpu.max", limits.CPUMax},
+		{"memory.max", limits.MemoryMax},
+		{"pids.max", uintValue(limits.PidsMax)},
+		{"io.weight", uintValue(limits.IOWeight)},
+	}
+	for _, file := range files {
+		if file.value == "" {
+			continue
+		}
+		if err := writeCgroupFile(c.path, file.name, file.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uintValue(value uint64) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+// apply makes the process start directly in the cgroup.
+func (c *cgroup) apply(attr *syscall.SysProcAttr) {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(c.dir.Fd())
+}
+
+// started releases the cgroup directory once the process is in.
+func (c *cgroup) started() {
+	if c.dir != nil {
+		c.dir.Close()
+		c.dir = nil
+	}
+}
+
+// oomKilled tells if the kernel OOM killer hit a process of the cgroup.
+func (c *cgroup) oomKilled() bool {
+	content, err := ioutil.ReadFile(filepath.Join(c.path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	return parseOomKills(string(content)) > 0
+}
+
+func parseOomKills(events string) int {
+	for _, line := range strings.Split(events, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			count, _ := strconv.Atoi(fields[1])
+			return count
+		}
+	}
+	return 0
+}
+
+// destroy kills what is left in the cgroup and removes it.
+func (c *cgroup) destroy() {
+	c.started()
+	if procs, err := ioutil.ReadFile(filepath.Join(c.path, "cgroup.procs")); err == nil && len(strings.TrimSpace(string(procs))) > 0 {
+		if err := writeCgroupFile(c.path, "cgroup.kill", "1"); err != nil {
+			for _, pid := range strings.Fields(string(procs)) {
+				if p, err := strconv.Atoi(pid); err == nil {
+					syscall.Kill(p, syscall.SIGKILL)
+				}
+			}
+		}
+	}
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = syscall.Rmdir(c.path); err == nil || err == syscall.ENOENT {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	logs.WithE(err).WithField("cgroup", c.path).Warn("Failed to remove cgroup")
+}
@@ -0,0 +1,55 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nyodas/forklift/forkliftcmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCgroup(t *testing.T) {
+	root := t.TempDir()
+	SetCgroupRoot(root)
+	defer SetCgroupRoot("")
+
+	c, err := newCgroup("/usr/bin/my job", forkliftcmd.Cgroup{CPUWeight: 50, MemoryMax: "64M", PidsMax: 32})
+	assert.NoError(t, err)
+	defer c.started()
+	assert.Equal(t, root, filepath.Dir(c.path))
+	assert.Regexp(t, "^my_job-[0-9]+$", filepath.Base(c.path))
+	for file, value := range map[string]string{"cpu.weight": "50", "memory.max": "64M", "pids.max": "32"} {
+		content, err := ioutil.ReadFile(filepath.Join(c.path, file))
+		assert.NoError(t, err)
+		assert.Equal(t, value, string(content))
+	}
+	_, err = os.Stat(filepath.Join(c.path, "cpu.max"))
+	assert.True(t, os.IsNotExist(err), "Unset limits shouldn't be written")
+}
+
+func TestParseOomKills(t *testing.T) {
+	assert.Equal(t, 2, parseOomKills("low 0\nhigh 0\nmax 3\noom 2\noom_kill 2\n"))
+	assert.Equal(t, 0, parseOomKills("low 0\noom_kill 0\n"))
+	assert.Equal(t, 0, parseOomKills(""))
+}
+
+func TestStartInCgroupOOM(t *testing.T) {
+	parent, err := ownCgroup()
+	if err != nil {
+		t.Skip("No cgroup v2: ", err)
+	}
+	controllers, _ := ioutil.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if !strings.Contains(string(controllers), "memory") {
+		t.Skip("Memory controller unavailable in ", parent)
+	}
+	r := NewRunner("/bin/sh", "/", []string{"-c", "cat /dev/zero | head -c 128m | tail > /dev/null"})
+	r.Cgroup = forkliftcmd.Cgroup{MemoryMax: "16M"}
+	r.Prepare()
+	r.Start()
+	assert.Equal(t, ExitReasonOOM, r.ExitReason)
+	_, err = os.Stat(r.cgroup.path)
+	assert.True(t, os.IsNotExist(err), "Cgroup should be removed after exit")
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+package runner
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/nyodas/forklift/forkliftcmd"
+)
+
+var errCgroupUnsupported = errors.New("cgroup limits are only supported on linux")
+
+type cgroup struct{}
+
+// SetCgroupRoot does nothing, commands can't get a cgroup outside linux.
+func SetCgroupRoot(root string) {}
+
+func newCgroup(name string, limits forkliftcmd.Cgroup) (*cgroup, error) {
+	return nil, errCgroupUnsupported
+}
+
+func (c *cgroup) apply(attr *syscall.SysProcAttr) {}
+
+func (c *cgroup) started() {}
+
+func (c *cgroup) oomKilled() bool {
+	return false
+}
+
+func (c *cgroup) destroy() {}
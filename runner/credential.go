@@ -0,0 +1,102 @@
+package runner
+
+import (
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// resolveCredential turns user, group and supplementary groups, given as
+// names or ids, into the credential the command runs with.
+// It returns nil when no user nor group is set.
+func resolveCredential(userName string, groupName string, groups []string) (*syscall.Credential, error) {
+	if userName == "" && groupName == "" && len(groups) == 0 {
+		return nil, nil
+	}
+	credential := &syscall.Credential{
+		Uid:    uint32(syscall.Getuid()),
+		Gid:    uint32(syscall.Getgid()),
+		Groups: []uint32{},
+	}
+	if userName != "" {
+		u, err := lookupUser(userName)
+		if err != nil {
+			return nil, err
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		credential.Uid = uint32(uid)
+		if gid, err := strconv.ParseUint(u.Gid, 10, 32); err == nil {
+			credential.Gid = uint32(gid)
+		}
+	}
+	if groupName != "" {
+		gid, err := lookupGroup(groupName)
+		if err != nil {
+			return nil, err
+		}
+		credential.Gid = gid
+	}
+	for _, name := range groups {
+		gid, err := lookupGroup(name)
+		if err != nil {
+			return nil, err
+		}
+		credential.Groups = append(credential.Groups, gid)
+	}
+	return credential, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		// unknown uids are allowed, they run with forklift's group
+		return &user.User{Uid: name}, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, errs.WithEF(err, data.WithField("user", name), "Unknown user")
+	}
+	return u, nil
+}
+
+func lookupGroup(name string) (uint32, error) {
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, errs.WithEF(err, data.WithField("group", name), "Unknown group")
+	}
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, errs.WithEF(err, data.WithField("group", name), "Invalid group id")
+	}
+	return uint32(gid), nil
+}
+
+// ResolveOwner returns the ids of a user and a group given as names or ids,
+// -1 for the empty ones as expected by os.Chown.
+func ResolveOwner(userName string, groupName string) (uid int, gid int, err error) {
+	uid, gid = -1, -1
+	if userName != "" {
+		u, err := lookupUser(userName)
+		if err != nil {
+			return uid, gid, err
+		}
+		id, _ := strconv.ParseUint(u.Uid, 10, 32)
+		uid = int(id)
+	}
+	if groupName != "" {
+		id, err := lookupGroup(groupName)
+		if err != nil {
+			return uid, gid, err
+		}
+		gid = int(id)
+	}
+	return uid, gid, nil
+}
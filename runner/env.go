@@ -0,0 +1,96 @@
+package runner
+
+import (
+	"bufio"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+// Environment describes the variables given to a command.
+// Later sources override earlier ones: inherited, EnvFiles, Env.
+type Environment struct {
+	Env      map[string]string
+	EnvFiles []string
+	ClearEnv bool
+	// Inherit lists the variables kept from forklift's environment when ClearEnv is set.
+	Inherit []string
+}
+
+// Environ builds the KEY=value list for exec.Cmd.Env, sorted by name.
+func (e Environment) Environ() ([]string, error) {
+	vars := make(map[string]string)
+	if e.ClearEnv {
+		for _, name := range e.Inherit {
+			if value, ok := os.LookupEnv(name); ok {
+				vars[name] = value
+			}
+		}
+	} else {
+		for _, kv := range os.Environ() {
+			if i := strings.IndexByte(kv, '='); i > 0 {
+				vars[kv[:i]] = kv[i+1:]
+			}
+		}
+	}
+	for _, file := range e.EnvFiles {
+		fileVars, err := ParseEnvFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range fileVars {
+			vars[name] = value
+		}
+	}
+	for name, value := range e.Env {
+		vars[name] = value
+	}
+
+	environ := make([]string, 0, len(vars))
+	for name, value := range vars {
+		environ = append(environ, name+"="+value)
+	}
+	sort.Strings(environ)
+	return environ, nil
+}
+
+// ParseEnvFile reads KEY=value lines, ignoring blank lines and # comments.
+// An "export " prefix and quotes around the value are stripped.
+func ParseEnvFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errs.WithEF(err, data.WithField("envFile", path), "Failed to open env file")
+	}
+	defer file.Close()
+
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.IndexByte(line, '=')
+		if i < 1 {
+			return nil, errs.WithF(data.WithField("envFile", path).WithField("line", lineNumber), "Invalid env file line")
+		}
+		name := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errs.WithEF(err, data.WithField("envFile", path), "Failed to read env file")
+	}
+	logs.WithField("envFile", path).WithField("count", len(vars)).Trace("Loaded env file")
+	return vars, nil
+}
@@ -0,0 +1,101 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/nyodas/forklift/forkliftcmd"
+)
+
+// limitsEnv carries the execLimits of a command to the trampoline,
+// umask and rlimits can't be set through SysProcAttr.
+const limitsEnv = "_FORKLIFT_EXEC_LIMITS"
+
+// selfExe re-executes the current binary as the trampoline.
+const selfExe = "/proc/self/exe"
+
+// rlimitNproc is RLIMIT_NPROC on linux, missing from the syscall package.
+const rlimitNproc = 0x6
+
+type execLimits struct {
+	Path    string
+	Umask   int
+	Rlimits forkliftcmd.Rlimits
+}
+
+// limitsTrampoline is set once the binary called MaybeExecLimits, only then
+// commands with a umask or rlimits can be started through it.
+var limitsTrampoline bool
+
+// MaybeExecLimits must be called first thing by the binaries running commands
+// with a umask or rlimits. When the binary was started as the trampoline of such
+// a command, it applies the limits found in its environment then execs the command,
+// it returns otherwise.
+func MaybeExecLimits() {
+	limitsTrampoline = true
+	spec, ok := os.LookupEnv(limitsEnv)
+	if !ok {
+		return
+	}
+	os.Unsetenv(limitsEnv)
+	var limits execLimits
+	if err := json.Unmarshal([]byte(spec), &limits); err != nil {
+		trampolineFail(err)
+	}
+	if err := limits.apply(); err != nil {
+		trampolineFail(err)
+	}
+	trampolineFail(syscall.Exec(limits.Path, os.Args, os.Environ()))
+}
+
+func trampolineFail(err error) {
+	fmt.Fprintf(os.Stderr, "forklift: failed to exec with limits: %s\n", err)
+	os.Exit(127)
+}
+
+func (l execLimits) apply() error {
+	if l.Umask >= 0 {
+		syscall.Umask(l.Umask)
+	}
+	rlimits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_NOFILE, l.Rlimits.NoFile},
+		{rlimitNproc, l.Rlimits.NProc},
+		{syscall.RLIMIT_CPU, l.Rlimits.CPU},
+		{syscall.RLIMIT_AS, l.Rlimits.AS},
+	}
+	for _, rlimit := range rlimits {
+		if rlimit.value == 0 {
+			continue
+		}
+		limit := syscall.Rlimit{Cur: rlimit.value, Max: rlimit.value}
+		if err := syscall.Setrlimit(rlimit.resource, &limit); err != nil {
+			return fmt.Errorf("setrlimit %d to %d: %s", rlimit.resource, rlimit.value, err)
+		}
+	}
+	return nil
+}
+
+// applyLimits routes cmd through the trampoline when a umask or rlimits are set.
+func applyLimits(cmd *exec.Cmd, umask int, rlimits forkliftcmd.Rlimits) error {
+	if umask < 0 && rlimits.IsZero() {
+		return nil
+	}
+	if !limitsTrampoline {
+		return errs.WithF(data.WithField("command", cmd.Path), "Umask and rlimits need the binary to call runner.MaybeExecLimits")
+	}
+	spec, err := json.Marshal(execLimits{Path: cmd.Path, Umask: umask, Rlimits: rlimits})
+	if err != nil {
+		return err
+	}
+	cmd.Path = selfExe
+	cmd.Env = append(cmd.Env, limitsEnv+"="+string(spec))
+	return nil
+}
@@ -0,0 +1,44 @@
+package runner
+
+import (
+	"sync"
+	"time"
+)
+
+// Observer is told about the executions of every runner, to export metrics.
+type Observer interface {
+	// CommandExited is called after each execution, KilledBy is empty when the command ended on its own.
+	CommandExited(command string, status int, duration time.Duration, killedBy string)
+	// CommandRestarted is called when ExecLoop restarts a command.
+	CommandRestarted(command string)
+}
+
+var observer struct {
+	sync.RWMutex
+	Observer
+}
+
+// SetObserver sets the observer of every runner, nil removes it.
+func SetObserver(o Observer) {
+	observer.Lock()
+	defer observer.Unlock()
+	observer.Observer = o
+}
+
+func currentObserver() Observer {
+	observer.RLock()
+	defer observer.RUnlock()
+	return observer.Observer
+}
+
+func (r *Runner) notifyExited() {
+	if o := currentObserver(); o != nil {
+		o.CommandExited(r.Shortname, r.Status, r.Duration, r.KilledBy)
+	}
+}
+
+func (r *Runner) notifyRestarted() {
+	if o := currentObserver(); o != nil {
+		o.CommandRestarted(r.Shortname)
+	}
+}
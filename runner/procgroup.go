@@ -0,0 +1,81 @@
+package runner
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type groupProcess struct {
+	Pid     int
+	Command string
+}
+
+type procStat struct {
+	groupProcess
+	State string
+	Ppid  int
+	Pgrp  int
+}
+
+// signalGroup sends sig to every process in the group led by pid.
+func signalGroup(pid int, sig syscall.Signal) error {
+	return syscall.Kill(-pid, sig)
+}
+
+// groupProcesses lists the processes still alive in the process group pgid.
+func groupProcesses(pgid int) []groupProcess {
+	var procs []groupProcess
+	for _, proc := range listProcesses() {
+		if proc.State != "Z" && proc.Pgrp == pgid {
+			procs = append(procs, proc.groupProcess)
+		}
+	}
+	return procs
+}
+
+func listProcesses() []procStat {
+	var procs []procStat
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, stat := range stats {
+		content, err := ioutil.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		if proc, ok := parseProcStat(string(content)); ok {
+			procs = append(procs, proc)
+		}
+	}
+	return procs
+}
+
+// parseProcStat reads the pid, command, state, parent and process group of a /proc/<pid>/stat line.
+func parseProcStat(stat string) (proc procStat, ok bool) {
+	open := strings.IndexByte(stat, '(')
+	end := strings.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return proc, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(stat[:open]))
+	if err != nil {
+		return proc, false
+	}
+	// fields after the command: state ppid pgrp ...
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 3 {
+		return proc, false
+	}
+	proc = procStat{
+		groupProcess: groupProcess{Pid: pid, Command: stat[open+1 : end]},
+		State:        fields[0],
+	}
+	if proc.Ppid, err = strconv.Atoi(fields[1]); err != nil {
+		return proc, false
+	}
+	if proc.Pgrp, err = strconv.Atoi(fields[2]); err != nil {
+		return proc, false
+	}
+	return proc, true
+}
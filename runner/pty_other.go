@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package runner
+
+import (
+	"errors"
+	"os"
+)
+
+var errPtyUnsupported = errors.New("tty is only supported on linux")
+
+func openPty() (master *os.File, slave *os.File, err error) {
+	return nil, nil, errPtyUnsupported
+}
+
+func setWinsize(pty *os.File, rows uint16, cols uint16) error {
+	return errPtyUnsupported
+}
@@ -0,0 +1,80 @@
+package runner
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/n0rad/go-erlog/logs"
+)
+
+// childrenMu is held for reading while starting a tracked child and
+// for writing while reaping, so a zombie is never reaped before it is tracked.
+var childrenMu sync.RWMutex
+
+// trackedChildren are the pids waited for by their exec.Cmd, the reaper leaves them alone.
+var trackedChildren sync.Map
+
+func startTracked(cmd *exec.Cmd) error {
+	childrenMu.RLock()
+	defer childrenMu.RUnlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	trackedChildren.Store(cmd.Process.Pid, struct{}{})
+	return nil
+}
+
+func waitTracked(cmd *exec.Cmd) error {
+	defer trackedChildren.Delete(cmd.Process.Pid)
+	return cmd.Wait()
+}
+
+// RunTracked runs cmd without the reaper stealing its exit status.
+func RunTracked(cmd *exec.Cmd) error {
+	if err := startTracked(cmd); err != nil {
+		return err
+	}
+	return waitTracked(cmd)
+}
+
+// StartReaper makes forklift reap the zombies it inherits, as an init process would.
+func StartReaper() {
+	if os.Getpid() != 1 {
+		if err := setSubreaper(); err != nil {
+			logs.WithE(err).Warn("Failed to become a child subreaper")
+		}
+	}
+	sigchld := make(chan os.Signal, 1)
+	signal.Notify(sigchld, syscall.SIGCHLD)
+	go func() {
+		for range sigchld {
+			ReapZombies()
+		}
+	}()
+	ReapZombies()
+}
+
+// ReapZombies waits for every zombie child that no Runner is waiting for.
+func ReapZombies() {
+	childrenMu.Lock()
+	defer childrenMu.Unlock()
+	self := os.Getpid()
+	for _, proc := range listProcesses() {
+		if proc.State != "Z" || proc.Ppid != self {
+			continue
+		}
+		if _, ok := trackedChildren.Load(proc.Pid); ok {
+			continue
+		}
+		var status syscall.WaitStatus
+		if pid, err := syscall.Wait4(proc.Pid, &status, syscall.WNOHANG, nil); err == nil && pid > 0 {
+			logs.WithField("pid", pid).
+				WithField("command", proc.Command).
+				WithField("exitcode", status.ExitStatus()).
+				Debug("Reaped zombie")
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package runner
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/nyodas/forklift/forkliftcmd"
+)
+
+const (
+	DefaultMaxRetries    = 3
+	DefaultRestartWindow = 10 * time.Second
+	DefaultBackoff       = 100 * time.Millisecond
+	DefaultMaxBackoff    = 30 * time.Second
+	// backoffJitter is the fraction of the delay randomly added or removed.
+	backoffJitter = 0.2
+)
+
+// RestartPolicy decides whether ExecLoop restarts a command and how long it waits before.
+// Retries are counted until a run lasts longer than Window, a MaxRetries of -1 never gives up.
+type RestartPolicy struct {
+	Policy           string
+	MaxRetries       int
+	Window           time.Duration
+	Backoff          time.Duration
+	MaxBackoff       time.Duration
+	SuccessExitCodes []int
+}
+
+func NewRestartPolicy() RestartPolicy {
+	return RestartPolicy{
+		Policy:           forkliftcmd.RestartAlways,
+		MaxRetries:       DefaultMaxRetries,
+		Window:           DefaultRestartWindow,
+		Backoff:          DefaultBackoff,
+		MaxBackoff:       DefaultMaxBackoff,
+		SuccessExitCodes: []int{0},
+	}
+}
+
+func NewRestartPolicyFromConfig(cmdConfig forkliftcmd.ForkliftCommand) RestartPolicy {
+	policy := NewRestartPolicy()
+	if cmdConfig.Oneshot {
+		policy.Policy = forkliftcmd.RestartNever
+	} else if cmdConfig.Restart != "" {
+		policy.Policy = cmdConfig.Restart
+	}
+	if cmdConfig.MaxRetries != nil {
+		policy.MaxRetries = *cmdConfig.MaxRetries
+	}
+	if cmdConfig.RestartWindow != 0 {
+		policy.Window = cmdConfig.RestartWindow
+	}
+	if cmdConfig.Backoff != 0 {
+		policy.Backoff = cmdConfig.Backoff
+	}
+	if cmdConfig.MaxBackoff != 0 {
+		policy.MaxBackoff = cmdConfig.MaxBackoff
+	}
+	if len(cmdConfig.SuccessExitCodes) > 0 {
+		policy.SuccessExitCodes = cmdConfig.SuccessExitCodes
+	}
+	return policy
+}
+
+func (p RestartPolicy) IsSuccess(status int) bool {
+	for _, code := range p.SuccessExitCodes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (p RestartPolicy) ShouldRestart(status int) bool {
+	switch p.Policy {
+	case forkliftcmd.RestartNever:
+		return false
+	case forkliftcmd.RestartOnFailure:
+		return !p.IsSuccess(status)
+	}
+	return true
+}
+
+func (p RestartPolicy) RetriesExhausted(retries int) bool {
+	return p.MaxRetries >= 0 && retries >= p.MaxRetries
+}
+
+// Delay is the backoff before the given retry, doubling from Backoff up to MaxBackoff.
+func (p RestartPolicy) Delay(retry int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < retry && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	jitter := time.Duration(float64(delay) * backoffJitter)
+	if jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*jitter))) - jitter
+	}
+	return delay
+}
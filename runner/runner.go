@@ -1,16 +1,47 @@
 package runner
 
 import (
+	"io"
+	"os"
 	"os/exec"
-	"sort"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
 	"github.com/n0rad/go-erlog/logs"
+	"github.com/nyodas/forklift/forkliftcmd"
 	"github.com/nyodas/forklift/logstreamer"
 )
 
+const DefaultStopGracePeriod = 10 * time.Second
+
+// ExitReason values describe how the last execution ended.
+const (
+	ExitReasonExited      = "exited"
+	ExitReasonSignaled    = "signaled"
+	ExitReasonOOM         = "oom"
+	ExitReasonStartFailed = "start-failed"
+)
+
+// KilledBy values tell who stopped the last execution.
+const (
+	KilledByTimeout  = "timeout"
+	KilledByClient   = "client"
+	KilledByShutdown = "shutdown"
+)
+
+// orphanWaitDelay bounds how long Wait keeps reading the output pipes once
+// the command exited, leftover descendants may hold them open.
+const orphanWaitDelay = time.Second
+
+// ttyEOF is the end-of-transmission character, read as an EOF by a terminal in canonical mode.
+const ttyEOF = 0x04
+
 type Runner struct {
+	// Shortname names the command in metrics, its path without config.
+	Shortname    string
 	commandName  string
 	commandCwd   string
 	Args         []string
@@ -21,7 +52,41 @@ type Runner struct {
 	Status       int
 	Oneshot      bool
 	PostStopHook string
-	exitCode     []int
+	Restart      RestartPolicy
+
+	StopSignal      syscall.Signal
+	StopGracePeriod time.Duration
+	ReapOrphans     bool
+	Environment     Environment
+	User            string
+	Group           string
+	Groups          []string
+	Umask           int
+	Rlimits         forkliftcmd.Rlimits
+	Cgroup          forkliftcmd.Cgroup
+	TTY             bool
+	ExitReason      string
+	ExitSignal      syscall.Signal
+	KilledBy        string
+	Duration        time.Duration
+	// RetriesExhausted is set when the RestartPolicy gave up, Status keeps the last exit code.
+	RetriesExhausted bool
+
+	prepareErr error
+	cgroup     *cgroup
+	pty        *os.File
+	ptySlave   *os.File
+	ttyOutput  io.Writer
+
+	// maskArgs hides the secrets of the config from the logged args
+	maskArgs func(args []string) []string
+
+	mu       sync.Mutex
+	pid      int
+	killedBy string
+	exited   chan struct{}
+	quit     chan struct{}
+	quitOnce sync.Once
 }
 
 type RunnerSvc interface {
@@ -35,22 +100,117 @@ type RunnerSvc interface {
 
 func NewRunner(name string, commandCwd string, commandArgs []string) *Runner {
 	runner := &Runner{
+		Shortname:   name,
 		commandName: name,
 		commandCwd:  commandCwd,
 		Args:        commandArgs,
-		exitCode:    []int{120, 121, 122, 123, 124, 125, 126, 127},
 		Oneshot:     false,
+		Restart:     NewRestartPolicy(),
+		Environment: Environment{Env: make(map[string]string)},
+		Umask:       -1,
+		quit:        make(chan struct{}),
+
+		StopSignal:      forkliftcmd.DefaultStopSignal,
+		StopGracePeriod: DefaultStopGracePeriod,
+	}
+	return runner
+}
+
+func NewRunnerFromConfig(cmdConfig forkliftcmd.ForkliftCommand) *Runner {
+	runner := NewRunner(cmdConfig.Path, cmdConfig.Cwd, cmdConfig.Args)
+	if cmdConfig.Shortname != "" {
+		runner.Shortname = cmdConfig.Shortname
 	}
+	runner.maskArgs = cmdConfig.MaskArgs
+	runner.Timeout = cmdConfig.Timeout
+	runner.Oneshot = cmdConfig.Oneshot
+	runner.PostStopHook = cmdConfig.PostStopHook
+	runner.Restart = NewRestartPolicyFromConfig(cmdConfig)
+	if sig, err := forkliftcmd.ParseSignal(cmdConfig.StopSignal); err != nil {
+		logs.WithE(err).WithField("command", cmdConfig.Shortname).
+			Warn("Invalid stop signal, using default")
+	} else {
+		runner.StopSignal = sig
+	}
+	if cmdConfig.StopGracePeriod != 0 {
+		runner.StopGracePeriod = cmdConfig.StopGracePeriod
+	}
+	runner.ReapOrphans = cmdConfig.ReapOrphans
+	runner.Environment.EnvFiles = cmdConfig.EnvFile
+	runner.Environment.ClearEnv = cmdConfig.ClearEnv
+	runner.Environment.Inherit = cmdConfig.InheritEnv
+	for name, value := range cmdConfig.Env {
+		runner.Environment.Env[name] = value
+	}
+	runner.User = cmdConfig.User
+	runner.Group = cmdConfig.Group
+	runner.Groups = cmdConfig.Groups
+	if umask, err := forkliftcmd.ParseUmask(cmdConfig.Umask); err != nil {
+		logs.WithE(err).WithField("command", cmdConfig.Shortname).
+			Warn("Invalid umask, keeping forklift's")
+	} else {
+		runner.Umask = umask
+	}
+	runner.Rlimits = cmdConfig.Rlimits
+	runner.Cgroup = cmdConfig.Cgroup
+	runner.TTY = cmdConfig.TTY
 	return runner
 }
 
 func (r *Runner) SetLogger(stdOut logstreamer.LogStreamer, stdErr logstreamer.LogStreamer) {
 	r.TermStdOut = stdOut
 	r.TermStdErr = stdErr
+	if r.ptySlave != nil {
+		return
+	}
 	r.process.Stdout = stdOut
 	r.process.Stderr = stdErr
 }
 
+// SetTTYOutput sets where the raw terminal output goes in TTY mode.
+func (r *Runner) SetTTYOutput(output io.Writer) {
+	r.ttyOutput = output
+}
+
+// Resize sets the window size of the command terminal.
+func (r *Runner) Resize(rows uint16, cols uint16) error {
+	r.mu.Lock()
+	pty := r.pty
+	r.mu.Unlock()
+	if pty == nil {
+		return errs.WithF(data.WithField("command", r.commandName), "Command has no tty")
+	}
+	return setWinsize(pty, rows, cols)
+}
+
+// StdinPipe returns a pipe connected to the command stdin, it must be called between Prepare and Start.
+// Closing it sends an EOF, an end-of-transmission character in TTY mode.
+func (r *Runner) StdinPipe() (io.WriteCloser, error) {
+	if r.prepareErr != nil {
+		return nil, r.prepareErr
+	}
+	r.mu.Lock()
+	pty := r.pty
+	r.mu.Unlock()
+	if pty != nil {
+		return ptyInput{pty}, nil
+	}
+	stdin, err := r.process.StdinPipe()
+	if err != nil {
+		return nil, errs.WithEF(err, data.WithField("command", r.commandName), "Failed to open stdin")
+	}
+	return stdin, nil
+}
+
+type ptyInput struct {
+	*os.File
+}
+
+func (p ptyInput) Close() error {
+	_, err := p.Write([]byte{ttyEOF})
+	return err
+}
+
 func (r *Runner) Prepare() {
 	cmd := exec.Command(
 		r.commandName,
@@ -59,101 +219,405 @@ func (r *Runner) Prepare() {
 	stdOut := logstreamer.NewLogStreamerTerm("stdout", false, r.commandName)
 	stdErr := logstreamer.NewLogStreamerTerm("stderr", false, r.commandName)
 	r.process = cmd
+	r.mu.Lock()
+	r.pty, r.ptySlave = nil, nil
+	r.mu.Unlock()
 	r.SetLogger(stdOut, stdErr)
 	r.process.Dir = r.commandCwd
+	// own session and process group, so signals reach every descendant
+	r.process.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	r.prepareErr = r.prepareProcess()
+	if r.ReapOrphans {
+		r.process.WaitDelay = orphanWaitDelay
+	}
+	r.mu.Lock()
+	r.pid = 0
+	r.killedBy = ""
+	r.exited = make(chan struct{})
+	r.mu.Unlock()
+}
+
+// prepareProcess applies the environment, credential and limits of the command.
+func (r *Runner) prepareProcess() (err error) {
+	if r.process.Env, err = r.Environment.Environ(); err != nil {
+		return err
+	}
+	if r.process.SysProcAttr.Credential, err = resolveCredential(r.User, r.Group, r.Groups); err != nil {
+		return err
+	}
+	if err = applyLimits(r.process, r.Umask, r.Rlimits); err != nil {
+		return err
+	}
+	if r.TTY {
+		if err = r.preparePty(); err != nil {
+			return err
+		}
+	}
+	r.cgroup = nil
+	if !r.Cgroup.IsZero() {
+		if r.cgroup, err = newCgroup(r.commandName, r.Cgroup); err != nil {
+			return err
+		}
+		r.cgroup.apply(r.process.SysProcAttr)
+	}
+	return nil
+}
+
+// preparePty gives the command a pseudo-terminal as its controlling tty.
+func (r *Runner) preparePty() (err error) {
+	pty, slave, err := openPty()
+	if err != nil {
+		return errs.WithEF(err, data.WithField("command", r.commandName), "Failed to allocate tty")
+	}
+	r.mu.Lock()
+	r.pty, r.ptySlave = pty, slave
+	r.mu.Unlock()
+	r.process.Stdin = r.ptySlave
+	r.process.Stdout = r.ptySlave
+	r.process.Stderr = r.ptySlave
+	r.process.SysProcAttr.Setctty = true
+	r.process.SysProcAttr.Ctty = 0
+	if r.ttyOutput == nil {
+		r.ttyOutput = r.TermStdOut
+	}
+	return nil
+}
+
+// streamPty copies the terminal output until the command side is closed.
+func (r *Runner) streamPty() chan struct{} {
+	r.ptySlave.Close()
+	r.ptySlave = nil
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// reading fails with EIO once every slave end is closed
+		io.Copy(r.ttyOutput, r.pty)
+	}()
+	return done
+}
+
+func (r *Runner) closePty() {
+	if r.ptySlave != nil {
+		r.ptySlave.Close()
+		r.ptySlave = nil
+	}
+	if r.pty != nil {
+		r.pty.Close()
+	}
 }
 
 func (r *Runner) Start() int {
 	r.Status = 0
+	r.ExitReason = ExitReasonStartFailed
+	r.ExitSignal = 0
+	r.KilledBy = ""
+	r.Duration = 0
 	var timer *time.Timer
+	defer close(r.exited)
+	defer r.notifyExited()
 	logs.WithField("command", r.commandName).
-		WithField("args", r.Args).
+		WithField("args", r.loggedArgs()).
 		WithField("timeout", r.Timeout).
 		Debug("Executing command")
 
-	if err := r.process.Start(); err != nil {
+	if r.prepareErr != nil {
+		logs.WithE(r.prepareErr).WithField("command", r.commandName).
+			Error("Failed to prepare command")
+		r.Status = 127
+		return r.Status
+	}
+	if err := startTracked(r.process); err != nil {
 		logs.WithE(err).WithField("command", r.commandName).
-			WithField("args", r.Args).
+			WithField("args", r.loggedArgs()).
 			Error("Error executing command")
+		if r.cgroup != nil {
+			r.cgroup.destroy()
+		}
+		r.closePty()
+		r.Status = 127
+		return r.Status
+	}
+	startTime := time.Now()
+	if r.cgroup != nil {
+		r.cgroup.started()
+	}
+	var ttyDone chan struct{}
+	if r.pty != nil {
+		ttyDone = r.streamPty()
+	}
+	r.mu.Lock()
+	r.pid = r.process.Process.Pid
+	r.mu.Unlock()
+	if r.isShutdown() {
+		// Shutdown raced with the start, it couldn't see the process yet
+		go r.StopBy(KilledByShutdown)
 	}
 	if r.Timeout != 0 {
 		timer = r.LaunchTimeout()
 	}
-	if err := r.process.Wait(); err != nil {
+	if err := waitTracked(r.process); err != nil {
 		logs.WithE(err).WithField("command", r.commandName).
-			WithField("args", r.Args).
+			WithField("args", r.loggedArgs()).
 			Error("Error executing command")
-		err_cmd := err.(*exec.ExitError)
-		r.Status = err_cmd.Sys().(syscall.WaitStatus).ExitStatus()
 	}
+	if ttyDone != nil {
+		select {
+		case <-ttyDone:
+		case <-time.After(orphanWaitDelay):
+		}
+		r.closePty()
+	}
+	r.Duration = time.Since(startTime)
+	r.Status = exitStatus(r.process.ProcessState)
+	r.ExitReason = exitReason(r.process.ProcessState)
+	r.ExitSignal = exitSignal(r.process.ProcessState)
+	r.mu.Lock()
+	r.KilledBy = r.killedBy
+	r.mu.Unlock()
 	if r.Timeout != 0 {
 		timer.Stop()
 	}
+	if r.ReapOrphans {
+		r.reapOrphans()
+	}
+	if r.cgroup != nil {
+		if r.cgroup.oomKilled() {
+			r.ExitReason = ExitReasonOOM
+			logs.WithField("command", r.commandName).
+				WithField("memoryMax", r.Cgroup.MemoryMax).
+				Error("Command killed by the OOM killer")
+		}
+		r.cgroup.destroy()
+	}
 	logs.WithField("command", r.commandName).
 		WithField("process", r.process.ProcessState).
 		WithField("exitcode", r.Status).
+		WithField("reason", r.ExitReason).
+		WithField("killedBy", r.KilledBy).
+		WithField("duration", r.Duration).
 		Debug("Command exited")
 	r.TermStdOut.Flush()
 	r.TermStdErr.Flush()
 	return r.Status
 }
 
+// Stop sends StopSignal to the process and waits up to StopGracePeriod
+// for it to exit before killing it.
 func (r *Runner) Stop() {
-	logs.WithField("command", r.commandName).Info("Stoping command")
-	r.process.Process.Kill()
-	r.TermStdOut.Flush()
-	r.TermStdErr.Flush()
+	r.stop(r.StopSignal, "")
+}
+
+// StopBy is Stop recording who stopped the command in KilledBy.
+func (r *Runner) StopBy(killedBy string) {
+	r.stop(r.StopSignal, killedBy)
+}
+
+// Signal sends sig to the process group of the running command.
+func (r *Runner) Signal(sig syscall.Signal) error {
+	pid := r.Pid()
+	if pid == 0 {
+		return errs.WithF(data.WithField("command", r.commandName), "Command not running")
+	}
+	return signalGroup(pid, sig)
+}
+
+func (r *Runner) stop(sig syscall.Signal, killedBy string) {
+	r.mu.Lock()
+	pid, exited := r.pid, r.exited
+	r.mu.Unlock()
+	if pid == 0 {
+		logs.WithField("command", r.commandName).Debug("Command not started, nothing to stop")
+		return
+	}
+	select {
+	case <-exited:
+		logs.WithField("command", r.commandName).Debug("Command already exited, nothing to stop")
+		return
+	default:
+	}
+	if killedBy != "" {
+		r.mu.Lock()
+		if r.killedBy == "" {
+			r.killedBy = killedBy
+		}
+		r.mu.Unlock()
+	}
+	logs.WithField("command", r.commandName).
+		WithField("signal", sig).
+		WithField("grace", r.StopGracePeriod).
+		Info("Stoping command")
+	if err := signalGroup(pid, sig); err != nil {
+		logs.WithE(err).WithField("command", r.commandName).
+			Debug("Failed to send stop signal")
+	}
+	grace := time.NewTimer(r.StopGracePeriod)
+	defer grace.Stop()
+	select {
+	case <-exited:
+	case <-grace.C:
+		logs.WithField("command", r.commandName).
+			WithField("grace", r.StopGracePeriod).
+			Warn("Grace period expired, killing command")
+		signalGroup(pid, syscall.SIGKILL)
+	}
+}
+
+// reapOrphans reports and kills the descendants left in the process group
+// once the command itself exited.
+func (r *Runner) reapOrphans() {
+	pgid := r.process.Process.Pid
+	orphans := groupProcesses(pgid)
+	if len(orphans) == 0 {
+		return
+	}
+	logs.WithField("command", r.commandName).
+		WithField("pgid", pgid).
+		WithField("orphans", orphans).
+		Warn("Killing leftover processes")
+	if err := signalGroup(pgid, syscall.SIGKILL); err != nil {
+		logs.WithE(err).WithField("pgid", pgid).Error("Failed to kill leftover processes")
+	}
+}
+
+func (r *Runner) isShutdown() bool {
+	select {
+	case <-r.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func exitReason(state *os.ProcessState) string {
+	if state == nil {
+		return ExitReasonStartFailed
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return ExitReasonSignaled
+	}
+	return ExitReasonExited
+}
+
+// exitSignal is the signal that terminated the process, 0 if it exited.
+func exitSignal(state *os.ProcessState) syscall.Signal {
+	if state == nil {
+		return 0
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return status.Signal()
+	}
+	return 0
+}
+
+func exitStatus(state *os.ProcessState) int {
+	if state == nil {
+		return -1
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok {
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	}
+	return state.ExitCode()
+}
+
+// Pid returns the pid of the running command, 0 when it isn't running.
+func (r *Runner) Pid() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.exited:
+		return 0
+	default:
+		return r.pid
+	}
+}
+
+// Shutdown stops the command and prevents ExecLoop from restarting it.
+func (r *Runner) Shutdown() {
+	r.ShutdownWith(r.StopSignal)
+}
+
+// ShutdownWith is Shutdown with sig sent instead of StopSignal.
+func (r *Runner) ShutdownWith(sig syscall.Signal) {
+	r.quitOnce.Do(func() {
+		close(r.quit)
+	})
+	r.stop(sig, KilledByShutdown)
 }
 
 func (r *Runner) LaunchTimeout() *time.Timer {
-	var timer *time.Timer
 	logs.WithField("timeout", r.Timeout).Debug("Setting timeout")
-	timer = time.AfterFunc(r.Timeout, func() {
-		logs.WithField("timeout", r.Timeout).Debug("Timeout triggered")
-		timer.Stop()
-		r.Stop()
+	return time.AfterFunc(r.Timeout, func() {
+		logs.WithField("command", r.commandName).
+			WithField("timeout", r.Timeout).
+			Warn("Command timed out")
+		r.StopBy(KilledByTimeout)
 	})
-	return timer
 }
 
+// ExecLoop runs the command until its RestartPolicy says otherwise,
+// then runs the PostStopHook of oneshot commands.
 func (r *Runner) ExecLoop() {
-	restartIntTime := 0
-	restartIntStatus := 0
-	lastStart := time.Now()
+	retries := 0
+	r.RetriesExhausted = false
 	for {
 		r.Prepare()
-		logs.WithField("command", r.commandName).
-			WithField("args", r.Args).
-			WithField("restart", restartIntTime).
-			WithField("oneshot", r.Oneshot).
-			WithField("lastStart", time.Since(lastStart)).
-			Debug("Restart")
-		if time.Since(lastStart) < 1000*time.Millisecond {
-			restartIntTime += 1
-		} else {
-			restartIntTime = 1
+		lastStart := time.Now()
+		status := r.Start()
+		if time.Since(lastStart) >= r.Restart.Window {
+			retries = 0
+		}
+		if r.isShutdown() {
+			logs.WithField("command", r.commandName).Debug("Command shut down, not restarting")
+			break
 		}
-		if sort.SearchInts(r.exitCode, r.Status) > 0 {
-			restartIntStatus += 1
-		} else if restartIntStatus > 0 {
-			restartIntStatus -= 1
+		if r.Oneshot || !r.Restart.ShouldRestart(status) {
+			logs.WithField("command", r.commandName).
+				WithField("exitCode", status).
+				WithField("restart", r.Restart.Policy).
+				WithField("oneshot", r.Oneshot).
+				Debug("Not restarting command")
+			break
 		}
-		lastStart = time.Now()
-		_ = r.Start()
-		if restartIntTime == 3 || restartIntStatus == 3 {
-			logs.WithField("restartTime", restartIntTime).
-				WithField("restartFail", restartIntStatus).
-				WithField("exitCode", r.Status).
+		if r.Restart.RetriesExhausted(retries) {
+			logs.WithField("command", r.commandName).
+				WithField("retries", retries).
+				WithField("exitCode", status).
 				WithField("lastStart", time.Since(lastStart)).
 				Info("Restart Limit Reached")
-			r.Status = 1
+			r.RetriesExhausted = true
 			break
-		} else if r.Oneshot {
-			cmd := exec.Command(
-				r.PostStopHook,
-			)
-			cmd.Run()
+		}
+		retries++
+		r.notifyRestarted()
+		delay := r.Restart.Delay(retries)
+		logs.WithField("command", r.commandName).
+			WithField("args", r.loggedArgs()).
+			WithField("retry", retries).
+			WithField("exitCode", status).
+			WithField("backoff", delay).
+			Debug("Restart")
+		select {
+		case <-r.quit:
+		case <-time.After(delay):
+		}
+		if r.isShutdown() {
 			break
 		}
 	}
+	if r.Oneshot && r.PostStopHook != "" {
+		cmd := exec.Command(
+			r.PostStopHook,
+		)
+		RunTracked(cmd)
+	}
+}
+
+func (r *Runner) loggedArgs() []string {
+	if r.maskArgs == nil {
+		return r.Args
+	}
+	return r.maskArgs(r.Args)
 }
@@ -0,0 +1,395 @@
+package runner
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nyodas/forklift/forkliftcmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	MaybeExecLimits()
+	os.Exit(m.Run())
+}
+
+func startRunner(r *Runner) chan int {
+	status := make(chan int, 1)
+	r.Prepare()
+	go func() {
+		status <- r.Start()
+	}()
+	// leave the shell enough time to install its traps
+	time.Sleep(200 * time.Millisecond)
+	return status
+}
+
+func TestNewRunnerFromConfig(t *testing.T) {
+	r := NewRunnerFromConfig(forkliftcmd.ForkliftCommand{
+		Path:            "/bin/sleep",
+		Args:            forkliftcmd.Args{"10"},
+		StopSignal:      "SIGQUIT",
+		StopGracePeriod: time.Second,
+	})
+	assert.Equal(t, []string{"10"}, r.Args)
+	assert.Equal(t, syscall.SIGQUIT, r.StopSignal)
+	assert.Equal(t, time.Second, r.StopGracePeriod)
+
+	r = NewRunnerFromConfig(forkliftcmd.ForkliftCommand{Path: "/bin/sleep"})
+	assert.Equal(t, syscall.SIGTERM, r.StopSignal)
+	assert.Equal(t, DefaultStopGracePeriod, r.StopGracePeriod)
+}
+
+func TestStopGraceful(t *testing.T) {
+	r := NewRunner("/bin/sh", "/", []string{"-c", "trap 'exit 42' TERM; while true; do sleep 0.05; done"})
+	status := startRunner(r)
+	r.Stop()
+	assert.Equal(t, 42, <-status, "Command should exit through its TERM trap")
+}
+
+func TestStopEscalatesToKill(t *testing.T) {
+	r := NewRunner("/bin/sh", "/", []string{"-c", "trap '' TERM; while true; do sleep 0.05; done"})
+	r.StopGracePeriod = 300 * time.Millisecond
+	status := startRunner(r)
+	start := time.Now()
+	r.Stop()
+	<-status
+	assert.True(t, time.Since(start) >= r.StopGracePeriod, "Stop should wait for the grace period")
+	assert.True(t, r.process.ProcessState.Sys().(syscall.WaitStatus).Signaled())
+}
+
+func TestStopNotStarted(t *testing.T) {
+	r := NewRunner("/bin/true", "/", nil)
+	r.Stop()
+}
+
+func TestStopKillsProcessGroup(t *testing.T) {
+	r := NewRunner("/bin/sh", "/", []string{"-c", "sleep 30 & sleep 30 & wait"})
+	status := startRunner(r)
+	pgid := r.Pid()
+	assert.Len(t, groupProcesses(pgid), 3, "Shell and both sleeps should share a group")
+	r.Stop()
+	<-status
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, groupProcesses(pgid), "Stop should reach the whole group")
+}
+
+func TestReapOrphans(t *testing.T) {
+	r := NewRunner("/bin/sh", "/", []string{"-c", "sleep 30 & exit 3"})
+	r.ReapOrphans = true
+	r.Prepare()
+	assert.Equal(t, 3, r.Start())
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, groupProcesses(r.process.Process.Pid), "Leftover sleep should be killed")
+}
+
+func TestParseProcStat(t *testing.T) {
+	proc, ok := parseProcStat("1234 (sleep (x)) S 1 1200 1200 0 -1")
+	assert.True(t, ok)
+	assert.Equal(t, groupProcess{Pid: 1234, Command: "sleep (x)"}, proc.groupProcess)
+	assert.Equal(t, "S", proc.State)
+	assert.Equal(t, 1, proc.Ppid)
+	assert.Equal(t, 1200, proc.Pgrp)
+
+	_, ok = parseProcStat("garbage")
+	assert.False(t, ok)
+}
+
+func TestRestartPolicyShouldRestart(t *testing.T) {
+	policy := NewRestartPolicy()
+	policy.SuccessExitCodes = []int{0, 3}
+	var restartTests = []struct {
+		policy string
+		status int
+		out    bool
+	}{
+		{forkliftcmd.RestartAlways, 0, true},
+		{forkliftcmd.RestartAlways, 1, true},
+		{forkliftcmd.RestartOnFailure, 0, false},
+		{forkliftcmd.RestartOnFailure, 3, false},
+		{forkliftcmd.RestartOnFailure, 127, true},
+		{forkliftcmd.RestartNever, 1, false},
+	}
+	for _, tt := range restartTests {
+		policy.Policy = tt.policy
+		assert.Equal(t, tt.out, policy.ShouldRestart(tt.status), "%s with status %d", tt.policy, tt.status)
+	}
+}
+
+func TestRestartPolicyDelay(t *testing.T) {
+	policy := NewRestartPolicy()
+	policy.Backoff = 100 * time.Millisecond
+	policy.MaxBackoff = time.Second
+	for retry, base := range []time.Duration{100, 100, 200, 400, 800, 1000, 1000} {
+		delay := policy.Delay(retry)
+		base = base * time.Millisecond
+		assert.InDelta(t, float64(base), float64(delay), float64(base)*backoffJitter, "retry %d", retry)
+	}
+}
+
+func TestRestartPolicyRetriesExhausted(t *testing.T) {
+	policy := NewRestartPolicy()
+	policy.MaxRetries = 2
+	assert.False(t, policy.RetriesExhausted(1))
+	assert.True(t, policy.RetriesExhausted(2))
+	policy.MaxRetries = -1
+	assert.False(t, policy.RetriesExhausted(1000), "Negative MaxRetries never gives up")
+}
+
+func TestExecLoopGivesUp(t *testing.T) {
+	r := NewRunner("/bin/sh", "/", []string{"-c", "exit 2"})
+	r.Restart.Policy = forkliftcmd.RestartOnFailure
+	r.Restart.MaxRetries = 2
+	r.Restart.Backoff = 10 * time.Millisecond
+	r.ExecLoop()
+	assert.True(t, r.RetriesExhausted, "Restart limit should be reported")
+	assert.Equal(t, 2, r.Status, "Restart limit should keep the last exit code")
+}
+
+func TestExecLoopOnFailureStopsOnSuccess(t *testing.T) {
+	r := NewRunner("/bin/sh", "/", []string{"-c", "exit 3"})
+	r.Restart.Policy = forkliftcmd.RestartOnFailure
+	r.Restart.SuccessExitCodes = []int{3}
+	r.ExecLoop()
+	assert.Equal(t, 3, r.Status)
+}
+
+func TestExecLoopNeverRestartsWithZeroMaxRetries(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	maxRetries := 0
+	r := NewRunnerFromConfig(forkliftcmd.ForkliftCommand{
+		Path:       "/bin/sh",
+		Args:       forkliftcmd.Args{"-c", "echo run >> " + runs + "; exit 2"},
+		MaxRetries: &maxRetries,
+	})
+	r.ExecLoop()
+	content, err := ioutil.ReadFile(runs)
+	assert.NoError(t, err)
+	assert.Equal(t, "run\n", string(content), "maxRetries 0 should never restart")
+	assert.Equal(t, DefaultMaxRetries, NewRunnerFromConfig(forkliftcmd.ForkliftCommand{Path: "/bin/sh"}).Restart.MaxRetries)
+}
+
+func TestExecLoopPostStopHookOneshotOnly(t *testing.T) {
+	dir := t.TempDir()
+	hook := filepath.Join(dir, "hook.sh")
+	assert.NoError(t, ioutil.WriteFile(hook, []byte("#!/bin/sh\necho ran >> "+filepath.Join(dir, "ran")+"\n"), 0755))
+
+	r := NewRunner("/bin/sh", "/", []string{"-c", "exit 2"})
+	r.Restart.MaxRetries = 1
+	r.Restart.Backoff = 10 * time.Millisecond
+	r.PostStopHook = hook
+	r.ExecLoop()
+	_, err := os.Stat(filepath.Join(dir, "ran"))
+	assert.True(t, os.IsNotExist(err), "PostStopHook should only run for oneshot commands")
+
+	r.Oneshot = true
+	r.ExecLoop()
+	content, err := ioutil.ReadFile(filepath.Join(dir, "ran"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ran\n", string(content))
+}
+
+func zombieChildren() []procStat {
+	var zombies []procStat
+	for _, proc := range listProcesses() {
+		if proc.State == "Z" && proc.Ppid == os.Getpid() {
+			zombies = append(zombies, proc)
+		}
+	}
+	return zombies
+}
+
+func TestReapZombies(t *testing.T) {
+	if err := setSubreaper(); err != nil {
+		t.Skip("Child subreaper unavailable: ", err)
+	}
+	assert.NoError(t, RunTracked(exec.Command("/bin/sh", "-c", "sleep 0.1 &")))
+	time.Sleep(300 * time.Millisecond)
+	assert.NotEmpty(t, zombieChildren(), "Orphaned sleep should be a zombie of ours")
+	ReapZombies()
+	assert.Empty(t, zombieChildren())
+}
+
+func TestReapZombiesLeavesTrackedChildren(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "exit 5")
+	assert.NoError(t, startTracked(cmd))
+	time.Sleep(100 * time.Millisecond)
+	ReapZombies()
+	waitTracked(cmd)
+	assert.Equal(t, 5, exitStatus(cmd.ProcessState), "Runner should still get its exit code")
+}
+
+func TestEnvironment(t *testing.T) {
+	os.Setenv("FORKLIFT_TEST_KEPT", "kept")
+	os.Setenv("FORKLIFT_TEST_DROPPED", "dropped")
+	envFile := t.TempDir() + "/env"
+	ioutil.WriteFile(envFile, []byte("# comment\n\nexport FROM_FILE=\"file value\"\nOVERRIDDEN=file\n"), 0644)
+
+	environ, err := Environment{
+		Env:      map[string]string{"OVERRIDDEN": "env"},
+		EnvFiles: []string{envFile},
+		ClearEnv: true,
+		Inherit:  []string{"FORKLIFT_TEST_KEPT", "FORKLIFT_TEST_UNSET"},
+	}.Environ()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"FORKLIFT_TEST_KEPT=kept", "FROM_FILE=file value", "OVERRIDDEN=env"}, environ)
+
+	environ, err = Environment{}.Environ()
+	assert.NoError(t, err)
+	assert.Contains(t, environ, "FORKLIFT_TEST_DROPPED=dropped", "Environment is inherited by default")
+}
+
+func TestParseEnvFileErrors(t *testing.T) {
+	_, err := ParseEnvFile("/nonexistent/env")
+	assert.Error(t, err)
+
+	envFile := t.TempDir() + "/env"
+	ioutil.WriteFile(envFile, []byte("VALID=1\nnot a variable\n"), 0644)
+	_, err = ParseEnvFile(envFile)
+	assert.Error(t, err, "Lines without = should be rejected")
+}
+
+func TestStartWithEnvironment(t *testing.T) {
+	r := NewRunner("/bin/sh", "/", []string{"-c", `test "$FOO" = bar && test -z "$HOME"`})
+	r.Environment = Environment{Env: map[string]string{"FOO": "bar"}, ClearEnv: true}
+	r.Prepare()
+	assert.Equal(t, 0, r.Start())
+
+	r.Environment.EnvFiles = []string{"/nonexistent/env"}
+	r.Prepare()
+	assert.Equal(t, 127, r.Start(), "Missing env file should prevent the start")
+}
+
+func TestStartAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Switching user needs root")
+	}
+	r := NewRunner("/bin/sh", "/", []string{"-c", `test "$(id -u)" = 65534 && test "$(id -g)" = 65533 && test "$(id -G)" = "65533 65532"`})
+	r.User = "65534"
+	r.Group = "65533"
+	r.Groups = []string{"65532"}
+	r.Prepare()
+	assert.Equal(t, 0, r.Start())
+}
+
+func TestStartWithLimits(t *testing.T) {
+	r := NewRunner("/bin/sh", "/", []string{"-c", `test "$(umask)" = 0027 && test "$(ulimit -n)" = 64 && test -z "$` + limitsEnv + `"`})
+	r.Umask = 027
+	r.Rlimits = forkliftcmd.Rlimits{NoFile: 64}
+	r.Prepare()
+	assert.Equal(t, 0, r.Start())
+}
+
+func TestLimitsNeedTrampoline(t *testing.T) {
+	limitsTrampoline = false
+	defer func() { limitsTrampoline = true }()
+	cmd := exec.Command("/bin/true")
+	assert.Error(t, applyLimits(cmd, 027, forkliftcmd.Rlimits{}), "Limits shouldn't re-exec a binary not calling MaybeExecLimits")
+	assert.Equal(t, "/bin/true", cmd.Path)
+	assert.NoError(t, applyLimits(cmd, -1, forkliftcmd.Rlimits{}))
+}
+
+func TestResolveCredential(t *testing.T) {
+	credential, err := resolveCredential("", "", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, credential, "No user should keep forklift's credential")
+
+	credential, err = resolveCredential("root", "0", []string{"root"})
+	assert.NoError(t, err)
+	assert.Equal(t, &syscall.Credential{Uid: 0, Gid: 0, Groups: []uint32{0}}, credential)
+
+	_, err = resolveCredential("forklift-no-such-user", "", nil)
+	assert.Error(t, err)
+	_, err = resolveCredential("", "forklift-no-such-group", nil)
+	assert.Error(t, err)
+}
+
+func TestStartWithTTY(t *testing.T) {
+	output := &bytes.Buffer{}
+	r := NewRunner("/bin/sh", "/", []string{"-c", `test -t 0 && test -t 1 && stty size`})
+	r.TTY = true
+	r.SetTTYOutput(output)
+	r.Prepare()
+	assert.NoError(t, r.Resize(42, 120))
+	assert.Equal(t, 0, r.Start())
+	assert.Equal(t, "42 120", strings.TrimSpace(output.String()))
+}
+
+func TestResizeWithoutTTY(t *testing.T) {
+	r := NewRunner("/bin/true", "/", nil)
+	r.Prepare()
+	assert.Error(t, r.Resize(24, 80))
+}
+
+func TestStdinPipe(t *testing.T) {
+	r := NewRunner("/bin/sh", "/", []string{"-c", `read line && test "$line" = hello && ! read other`})
+	r.Prepare()
+	stdin, err := r.StdinPipe()
+	assert.NoError(t, err)
+	status := make(chan int, 1)
+	go func() {
+		status <- r.Start()
+	}()
+	_, err = stdin.Write([]byte("hello\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, stdin.Close())
+	assert.Equal(t, 0, <-status)
+}
+
+func TestStartTimeout(t *testing.T) {
+	r := NewRunner("/bin/sleep", "/", []string{"10"})
+	r.Timeout = 100 * time.Millisecond
+	r.Prepare()
+	assert.Equal(t, 128+int(syscall.SIGTERM), r.Start())
+	assert.Equal(t, KilledByTimeout, r.KilledBy)
+	assert.Equal(t, ExitReasonSignaled, r.ExitReason)
+	assert.Equal(t, syscall.SIGTERM, r.ExitSignal)
+	assert.True(t, r.Duration >= r.Timeout)
+}
+
+func TestStopByClient(t *testing.T) {
+	r := NewRunner("/bin/sh", "/", []string{"-c", `trap "exit 3" TERM; while true; do sleep 0.05; done`})
+	status := startRunner(r)
+	r.StopBy(KilledByClient)
+	assert.Equal(t, 3, <-status)
+	assert.Equal(t, KilledByClient, r.KilledBy)
+	assert.Equal(t, syscall.Signal(0), r.ExitSignal)
+
+	r.Args = []string{"-c", "exit 3"}
+	r.Prepare()
+	assert.Equal(t, 3, r.Start())
+	assert.Empty(t, r.KilledBy, "KilledBy should be reset for each execution")
+}
+
+type recordingObserver struct {
+	exits    []int
+	restarts int
+}
+
+func (o *recordingObserver) CommandExited(command string, status int, duration time.Duration, killedBy string) {
+	o.exits = append(o.exits, status)
+}
+
+func (o *recordingObserver) CommandRestarted(command string) {
+	o.restarts++
+}
+
+func TestObserver(t *testing.T) {
+	observer := &recordingObserver{}
+	SetObserver(observer)
+	defer SetObserver(nil)
+	r := NewRunner("/bin/sh", "/", []string{"-c", "exit 2"})
+	r.Restart.Policy = forkliftcmd.RestartOnFailure
+	r.Restart.MaxRetries = 2
+	r.Restart.Backoff = 10 * time.Millisecond
+	r.ExecLoop()
+	assert.Equal(t, []int{2, 2, 2}, observer.exits)
+	assert.Equal(t, 2, observer.restarts)
+}
@@ -0,0 +1,12 @@
+package runner
+
+import "syscall"
+
+const prSetChildSubreaper = 36
+
+func setSubreaper() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
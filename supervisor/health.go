@@ -0,0 +1,143 @@
+package supervisor
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/nyodas/forklift/forkliftcmd"
+	"github.com/nyodas/forklift/runner"
+)
+
+const (
+	HealthUnknown   = "unknown"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// Health is the result of the health checks of a service, empty without health check.
+type Health struct {
+	Status    string
+	Failures  int
+	LastCheck time.Time
+	LastError string
+}
+
+var probeClient = &http.Client{
+	// redirections are a success on their own, the target may not be probed
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (service *Service) Health() Health {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.health
+}
+
+// Live tells if the service is fine or can get fine without restarting forklift:
+// a critical service must be running and not unhealthy.
+func (service *Service) Live() bool {
+	if !service.Critical {
+		return true
+	}
+	state, health := service.State(), service.Health()
+	return state != StateExited && health.Status != HealthUnhealthy
+}
+
+// Ready tells if the service can do its job: it runs and passed its last health
+// check, or it is a oneshot command that succeeded. Stopped services are ignored.
+func (service *Service) Ready() bool {
+	state, health := service.State(), service.Health()
+	switch state {
+	case StateStopped:
+		return true
+	case StateExited:
+		return service.Config.Oneshot && service.Runner.Status == 0
+	}
+	if service.Runner.Pid() == 0 {
+		return false
+	}
+	return health.Status == "" || health.Status == HealthHealthy
+}
+
+// probe runs the health check of the service every interval until it ends.
+func (s *Supervisor) probe(service *Service) {
+	check := service.Config.HealthCheck
+	ticker := time.NewTicker(check.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-service.done:
+			return
+		case <-ticker.C:
+		}
+		if service.Runner.Pid() == 0 {
+			// restarting, the next run is probed
+			continue
+		}
+		service.recordProbe(runProbe(*check), check.Threshold)
+	}
+}
+
+func (service *Service) recordProbe(err error, threshold int) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	service.health.LastCheck = time.Now()
+	if err == nil {
+		if service.health.Status != HealthHealthy {
+			logs.WithField("command", service.Name).Info("Command is healthy")
+		}
+		service.health.Status = HealthHealthy
+		service.health.Failures = 0
+		service.health.LastError = ""
+		return
+	}
+	service.health.Failures++
+	service.health.LastError = strings.TrimSpace(err.Error())
+	logs.WithE(err).WithField("command", service.Name).
+		WithField("failures", service.health.Failures).
+		Debug("Health check failed")
+	if service.health.Failures >= threshold && service.health.Status != HealthUnhealthy {
+		service.health.Status = HealthUnhealthy
+		logs.WithE(err).WithField("command", service.Name).
+			WithField("failures", service.health.Failures).
+			Warn("Command is unhealthy")
+	}
+}
+
+func runProbe(check forkliftcmd.HealthCheck) error {
+	ctx, cancel := context.WithTimeout(context.Background(), check.Timeout)
+	defer cancel()
+	switch {
+	case len(check.Exec) > 0:
+		return runner.RunTracked(exec.CommandContext(ctx, check.Exec[0], check.Exec[1:]...))
+	case check.HTTP != "":
+		req, err := http.NewRequest(http.MethodGet, check.HTTP, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := probeClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			return errs.WithF(data.WithField("url", check.HTTP).WithField("status", resp.StatusCode), "Unhealthy http status")
+		}
+		return nil
+	default:
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", check.TCP)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
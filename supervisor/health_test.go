@@ -0,0 +1,82 @@
+package supervisor
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nyodas/forklift/forkliftcmd"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitHealth waits for the service health to reach status.
+func waitHealth(t *testing.T, service *Service, status string) Health {
+	deadline := time.Now().Add(5 * time.Second)
+	for service.Health().Status != status && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	health := service.Health()
+	assert.Equal(t, status, health.Status)
+	return health
+}
+
+func TestHealthCheck(t *testing.T) {
+	var unhealthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&unhealthy) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	s := NewSupervisor()
+	defer s.StopAll()
+	cmd := oneshot("web", "-c 'sleep 30'")
+	cmd.Critical = true
+	cmd.HealthCheck = &forkliftcmd.HealthCheck{HTTP: server.URL, Interval: 20 * time.Millisecond, Timeout: time.Second, Threshold: 2}
+	service, err := s.Add(cmd)
+	assert.NoError(t, err)
+	assert.False(t, service.Ready(), "Services should not be ready before their first check")
+	assert.True(t, service.Live())
+
+	waitHealth(t, service, HealthHealthy)
+	assert.True(t, service.Ready())
+
+	atomic.StoreInt32(&unhealthy, 1)
+	health := waitHealth(t, service, HealthUnhealthy)
+	assert.True(t, health.Failures >= 2)
+	assert.Contains(t, health.LastError, "status=500")
+	assert.False(t, service.Ready())
+	assert.False(t, service.Live(), "Unhealthy critical services should fail liveness")
+}
+
+func TestProbes(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := listener.Addr().String()
+	assert.NoError(t, runProbe(forkliftcmd.HealthCheck{TCP: addr, Timeout: time.Second}))
+	listener.Close()
+	assert.Error(t, runProbe(forkliftcmd.HealthCheck{TCP: addr, Timeout: time.Second}))
+
+	assert.NoError(t, runProbe(forkliftcmd.HealthCheck{Exec: []string{"/bin/true"}, Timeout: time.Second}))
+	assert.Error(t, runProbe(forkliftcmd.HealthCheck{Exec: []string{"/bin/false"}, Timeout: time.Second}))
+	start := time.Now()
+	assert.Error(t, runProbe(forkliftcmd.HealthCheck{Exec: []string{"/bin/sleep", "10"}, Timeout: 50 * time.Millisecond}))
+	assert.True(t, time.Since(start) < 5*time.Second, "Probes should be killed on timeout")
+}
+
+func TestReady(t *testing.T) {
+	s := NewSupervisor()
+	ok, err := s.Add(oneshot("ok", "-c 'exit 0'"))
+	assert.NoError(t, err)
+	failed, err := s.Add(oneshot("failed", "-c 'exit 3'"))
+	assert.NoError(t, err)
+	<-ok.Done()
+	<-failed.Done()
+	assert.True(t, ok.Ready(), "Succeeded oneshot commands should be ready")
+	assert.False(t, failed.Ready())
+	assert.True(t, failed.Live(), "Non critical commands should not fail liveness")
+}
@@ -0,0 +1,262 @@
+package supervisor
+
+import (
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/nyodas/forklift/forkliftcmd"
+	"github.com/nyodas/forklift/runner"
+)
+
+const (
+	StateRunning = "running"
+	StateExited  = "exited"
+	StateStopped = "stopped"
+)
+
+// Service is a named local command running in its own ExecLoop.
+type Service struct {
+	Name     string
+	Config   forkliftcmd.ForkliftCommand
+	Runner   *runner.Runner
+	Critical bool
+
+	mu      sync.Mutex
+	state   string
+	stopped bool
+	health  Health
+	done    chan struct{}
+}
+
+// Supervisor keeps a registry of services with independent lifecycles.
+// Done is closed as soon as a critical service ends.
+type Supervisor struct {
+	mu       sync.Mutex
+	services map[string]*Service
+	done     chan struct{}
+	doneOnce sync.Once
+	status   int
+}
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		services: make(map[string]*Service),
+		done:     make(chan struct{}),
+	}
+}
+
+// Add registers and starts a command, names must be unique.
+func (s *Supervisor) Add(cmdConfig forkliftcmd.ForkliftCommand) (*Service, error) {
+	name := cmdConfig.Name()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.services[name]; ok {
+		return nil, errs.WithF(data.WithField("command", name), "Command already supervised")
+	}
+	service := &Service{
+		Name:     name,
+		Config:   cmdConfig,
+		Runner:   runner.NewRunnerFromConfig(cmdConfig),
+		Critical: cmdConfig.Critical,
+		state:    StateRunning,
+		done:     make(chan struct{}),
+	}
+	if cmdConfig.HealthCheck != nil {
+		service.health.Status = HealthUnknown
+	}
+	s.services[name] = service
+	go s.run(service)
+	if cmdConfig.HealthCheck != nil {
+		go s.probe(service)
+	}
+	return service, nil
+}
+
+func (s *Supervisor) run(service *Service) {
+	logs.WithField("command", service.Name).
+		WithField("critical", service.Critical).
+		Info("Starting supervised command")
+	service.Runner.ExecLoop()
+
+	service.mu.Lock()
+	stopped := service.stopped
+	if stopped {
+		service.state = StateStopped
+	} else {
+		service.state = StateExited
+	}
+	service.mu.Unlock()
+	close(service.done)
+
+	logs.WithField("command", service.Name).
+		WithField("exitcode", service.Runner.Status).
+		WithField("retriesExhausted", service.Runner.RetriesExhausted).
+		WithField("stopped", stopped).
+		Info("Supervised command ended")
+	if service.Critical && !stopped {
+		status := service.Runner.Status
+		if status == 0 && service.Runner.RetriesExhausted {
+			status = 1
+		}
+		s.finish(status)
+	}
+}
+
+func (s *Supervisor) finish(status int) {
+	s.doneOnce.Do(func() {
+		s.mu.Lock()
+		s.status = status
+		s.mu.Unlock()
+		close(s.done)
+	})
+}
+
+// Reconcile makes the services match commands: added ones are started,
+// removed ones stopped and changed ones restarted, the others are left running.
+func (s *Supervisor) Reconcile(commands []forkliftcmd.ForkliftCommand) (added []string, changed []string, removed []string) {
+	var current []forkliftcmd.ForkliftCommand
+	for _, service := range s.List() {
+		current = append(current, service.Config)
+	}
+	added, changed, removed = forkliftcmd.DiffCommands(current, commands)
+	for _, name := range append(append([]string{}, changed...), removed...) {
+		logs.WithField("command", name).Info("Stopping command removed or changed in config")
+		if err := s.Remove(name); err != nil {
+			logs.WithE(err).WithField("command", name).Warn("Failed to stop command")
+		}
+	}
+	restart := make(map[string]bool)
+	for _, name := range append(append([]string{}, added...), changed...) {
+		restart[name] = true
+	}
+	for _, command := range commands {
+		if !restart[command.Name()] {
+			continue
+		}
+		if _, err := s.Add(command); err != nil {
+			logs.WithE(err).WithField("command", command.Name()).Error("Failed to start command")
+		}
+	}
+	return added, changed, removed
+}
+
+// Remove stops a service and forgets it.
+func (s *Supervisor) Remove(name string) error {
+	s.mu.Lock()
+	service, ok := s.services[name]
+	delete(s.services, name)
+	s.mu.Unlock()
+	if !ok {
+		return errs.WithF(data.WithField("command", name), "Command not supervised")
+	}
+	service.Stop()
+	return nil
+}
+
+func (s *Supervisor) Get(name string) *Service {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.services[name]
+}
+
+// List returns the services sorted by name.
+func (s *Supervisor) List() []*Service {
+	s.mu.Lock()
+	services := make([]*Service, 0, len(s.services))
+	for _, service := range s.services {
+		services = append(services, service)
+	}
+	s.mu.Unlock()
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	return services
+}
+
+// StopAll stops every service concurrently and waits for them.
+func (s *Supervisor) StopAll() {
+	s.stopAll(func(service *Service) {
+		service.Stop()
+	})
+}
+
+// Terminate stops every service with sig instead of their stop signal
+// and returns the status of the first critical one.
+func (s *Supervisor) Terminate(sig syscall.Signal) int {
+	s.stopAll(func(service *Service) {
+		service.stop(sig)
+	})
+	for _, service := range s.List() {
+		if service.Critical {
+			return service.Runner.Status
+		}
+	}
+	return 0
+}
+
+func (s *Supervisor) stopAll(stop func(service *Service)) {
+	var wg sync.WaitGroup
+	for _, service := range s.List() {
+		wg.Add(1)
+		go func(service *Service) {
+			defer wg.Done()
+			stop(service)
+		}(service)
+	}
+	wg.Wait()
+}
+
+// Signal forwards sig to every running service.
+func (s *Supervisor) Signal(sig syscall.Signal) {
+	for _, service := range s.List() {
+		if service.Runner.Pid() == 0 {
+			continue
+		}
+		logs.WithField("command", service.Name).
+			WithField("signal", sig).
+			Debug("Forwarding signal")
+		if err := service.Runner.Signal(sig); err != nil {
+			logs.WithE(err).WithField("command", service.Name).
+				Warn("Failed to forward signal")
+		}
+	}
+}
+
+// Done is closed when a critical service ended on its own.
+func (s *Supervisor) Done() <-chan struct{} {
+	return s.done
+}
+
+// ExitStatus is the status of the critical service that ended the supervisor.
+func (s *Supervisor) ExitStatus() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// Stop shuts the service down and waits for its ExecLoop to return.
+func (service *Service) Stop() {
+	service.stop(service.Runner.StopSignal)
+}
+
+func (service *Service) stop(sig syscall.Signal) {
+	service.mu.Lock()
+	service.stopped = true
+	service.mu.Unlock()
+	service.Runner.ShutdownWith(sig)
+	<-service.done
+}
+
+func (service *Service) State() string {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.state
+}
+
+func (service *Service) Done() <-chan struct{} {
+	return service.done
+}
@@ -0,0 +1,141 @@
+package supervisor
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mgutz/str"
+	"github.com/nyodas/forklift/forkliftcmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func oneshot(name string, args string) forkliftcmd.ForkliftCommand {
+	return forkliftcmd.ForkliftCommand{
+		Shortname: name,
+		Path:      "/bin/sh",
+		Args:      str.ToArgv(args),
+		Cwd:       "/",
+		Oneshot:   true,
+	}
+}
+
+func TestNonCriticalExitKeepsSupervisor(t *testing.T) {
+	s := NewSupervisor()
+	ls, err := s.Add(oneshot("ls", "-c 'exit 0'"))
+	assert.NoError(t, err)
+	sleep, err := s.Add(oneshot("sleep", "-c 'sleep 30'"))
+	assert.NoError(t, err)
+
+	<-ls.Done()
+	assert.Equal(t, StateExited, ls.State())
+	assert.Equal(t, StateRunning, sleep.State())
+	select {
+	case <-s.Done():
+		t.Error("A non critical command shouldn't end the supervisor")
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.StopAll()
+	assert.Equal(t, StateStopped, sleep.State())
+}
+
+func TestCriticalExitEndsSupervisor(t *testing.T) {
+	s := NewSupervisor()
+	critical := oneshot("critical", "-c 'exit 4'")
+	critical.Critical = true
+	_, err := s.Add(critical)
+	assert.NoError(t, err)
+	_, err = s.Add(oneshot("sleep", "-c 'sleep 30'"))
+	assert.NoError(t, err)
+
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Critical command exit should end the supervisor")
+	}
+	assert.Equal(t, 4, s.ExitStatus())
+	s.StopAll()
+}
+
+func TestAddDuplicate(t *testing.T) {
+	s := NewSupervisor()
+	_, err := s.Add(oneshot("sleep", "-c 'sleep 30'"))
+	assert.NoError(t, err)
+	_, err = s.Add(oneshot("sleep", "-c 'sleep 30'"))
+	assert.Error(t, err, "Shortnames should be unique")
+	s.StopAll()
+}
+
+func TestRemove(t *testing.T) {
+	s := NewSupervisor()
+	critical := oneshot("sleep", "-c 'sleep 30'")
+	critical.Critical = true
+	service, err := s.Add(critical)
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, s.Remove("sleep"))
+	assert.Equal(t, StateStopped, service.State())
+	assert.Nil(t, s.Get("sleep"))
+	assert.Error(t, s.Remove("sleep"), "Removing twice should fail")
+	select {
+	case <-s.Done():
+		t.Error("Removing a critical command shouldn't end the supervisor")
+	default:
+	}
+}
+
+func TestSignal(t *testing.T) {
+	s := NewSupervisor()
+	trap := oneshot("trap", `-c 'trap "exit 7" USR1; while true; do sleep 0.05; done'`)
+	trap.Critical = true
+	_, err := s.Add(trap)
+	assert.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+
+	s.Signal(syscall.SIGUSR1)
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Forwarded signal should reach the command")
+	}
+	assert.Equal(t, 7, s.ExitStatus())
+}
+
+func TestTerminate(t *testing.T) {
+	s := NewSupervisor()
+	critical := oneshot("sleep", "-c 'sleep 30'")
+	critical.Critical = true
+	_, err := s.Add(critical)
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 128+int(syscall.SIGINT), s.Terminate(syscall.SIGINT), "Exit code should reflect the forwarded signal")
+}
+
+func TestReconcile(t *testing.T) {
+	s := NewSupervisor()
+	defer s.StopAll()
+	keep, err := s.Add(oneshot("keep", "-c 'sleep 30'"))
+	assert.NoError(t, err)
+	changed, err := s.Add(oneshot("changed", "-c 'sleep 30'"))
+	assert.NoError(t, err)
+	removed, err := s.Add(oneshot("removed", "-c 'sleep 30'"))
+	assert.NoError(t, err)
+
+	added, restarted, stopped := s.Reconcile([]forkliftcmd.ForkliftCommand{
+		oneshot("keep", "-c 'sleep 30'"),
+		oneshot("changed", "-c 'sleep 40'"),
+		oneshot("added", "-c 'sleep 30'"),
+	})
+	assert.Equal(t, []string{"added"}, added)
+	assert.Equal(t, []string{"changed"}, restarted)
+	assert.Equal(t, []string{"removed"}, stopped)
+
+	assert.True(t, keep == s.Get("keep"), "Unchanged commands should not be restarted")
+	assert.Equal(t, StateRunning, keep.State())
+	assert.Equal(t, StateStopped, changed.State())
+	assert.Equal(t, forkliftcmd.Args{"-c", "sleep 40"}, s.Get("changed").Config.Args)
+	assert.Equal(t, StateStopped, removed.State())
+	assert.Nil(t, s.Get("removed"))
+	assert.NotNil(t, s.Get("added"))
+}